@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"smb-csi/driver/logging"
+	"sort"
+	"strings"
+)
+
+// PV annotation listing the nodes a volume is published on, comma separated.
+// It is kept on the PV, so a restarted or another controller instance sees the attachments as well.
+const attachedNodesAnnotation = "seitenbau.csi.smb/attached-nodes"
+
+// Access modes which allow publishing the volume on one node at a time only
+var singleNodeModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+}
+
+func parseAttachedNodes(annotations map[string]string) []string {
+	var nodes []string
+	for _, node := range strings.Split(annotations[attachedNodesAnnotation], ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func containsNode(nodes []string, nodeID string) bool {
+	for _, node := range nodes {
+		if node == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// updateAttachedNodes changes the attached nodes of the PV of the volume, retrying if the PV was changed concurrently.
+// update returns the new list of nodes or nil if nothing has to be changed.
+func (d *Driver) updateAttachedNodes(ctx context.Context, volumeID string, update func(nodes []string) ([]string, error)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pv, err := d.PVClient.Get(ctx, volumeID, v1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return status.Errorf(codes.NotFound, "Cannot find Volume with ID: %s", volumeID)
+			}
+			return status.Errorf(codes.Internal, "Failed reading Volume %s: %s", volumeID, err.Error())
+		}
+
+		nodes, err := update(parseAttachedNodes(pv.GetAnnotations()))
+		if err != nil || nodes == nil {
+			return err
+		}
+
+		annotations := pv.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		if len(nodes) == 0 {
+			delete(annotations, attachedNodesAnnotation)
+		} else {
+			sort.Strings(nodes)
+			annotations[attachedNodesAnnotation] = strings.Join(nodes, ",")
+		}
+		pv.SetAnnotations(annotations)
+
+		_, err = d.PVClient.Update(ctx, pv, v1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			return err
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "Failed recording the attachments of Volume %s: %s", volumeID, err.Error())
+		}
+		return nil
+	})
+}
+
+// attachVolume records the volume as published on the node.
+// A single node access mode is rejected with FailedPrecondition while the volume is published on another node.
+func (d *Driver) attachVolume(ctx context.Context, volumeID string, nodeID string, mode csi.VolumeCapability_AccessMode_Mode) error {
+	err := d.updateAttachedNodes(ctx, volumeID, func(nodes []string) ([]string, error) {
+		if containsNode(nodes, nodeID) {
+			return nil, nil
+		}
+		if singleNodeModes[mode] && len(nodes) > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "Volume %s with access mode %s is already published on node %s", volumeID, mode.String(), strings.Join(nodes, ", "))
+		}
+		return append(nodes, nodeID), nil
+	})
+	if status.Code(err) == codes.Unknown {
+		return status.Errorf(codes.Aborted, "Failed recording the attachment of Volume %s, it was changed concurrently: %s", volumeID, err.Error())
+	}
+	return err
+}
+
+// detachVolume removes the node from the nodes the volume is published on
+func (d *Driver) detachVolume(ctx context.Context, volumeID string, nodeID string) error {
+	err := d.updateAttachedNodes(ctx, volumeID, func(nodes []string) ([]string, error) {
+		if !containsNode(nodes, nodeID) {
+			logging.FromContext(ctx, "controller").Info("Volume is not published on the node")
+			return nil, nil
+		}
+		remaining := []string{}
+		for _, node := range nodes {
+			if node != nodeID {
+				remaining = append(remaining, node)
+			}
+		}
+		return remaining, nil
+	})
+	if status.Code(err) == codes.Unknown {
+		return status.Errorf(codes.Aborted, "Failed removing the attachment of Volume %s, it was changed concurrently: %s", volumeID, err.Error())
+	}
+	return err
+}
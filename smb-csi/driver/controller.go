@@ -5,15 +5,18 @@ import (
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/otiai10/copy"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/klog/v2"
 	"os"
 	"path/filepath"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/metrics"
 	"smb-csi/driver/snapshotter"
+	"smb-csi/driver/tracing"
 	"sort"
 	"strconv"
 	"strings"
@@ -21,8 +24,6 @@ import (
 )
 
 func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	klog.Infof("create request: %+v", request)
-
 	requestCapacity := request.GetCapacityRange().GetRequiredBytes()
 	requestContentSource := request.GetVolumeContentSource()
 	requestedVolumeID := request.GetName()
@@ -38,11 +39,39 @@ func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 
 	if requestedVolumeID == "" { return nil, status.Error(codes.InvalidArgument, "No VolumeID specified") }
 
+	subDir, err := resolveSubDir(requestedVolumeID, requestParameters)
+	if err != nil {
+		return nil, err
+	}
+	permissions, err := parseDirPermissions(requestParameters)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := smbVersionCandidates(requestParameters); err != nil {
+		return nil, err
+	}
+	if err := d.validateCapabilities(request.GetVolumeCapabilities()); err != nil {
+		return nil, err
+	}
+	if err := checkCapabilitiesSecurityMode(requestParameters, request.GetVolumeCapabilities(), request.GetSecrets()); err != nil {
+		return nil, err
+	}
+	volumeContext := buildVolumeContext(requestParameters, subDir)
+
+	if err := d.volumeLocks.Acquire(requestedVolumeID, "CreateVolume"); err != nil {
+		return nil, err
+	}
+	defer d.volumeLocks.Release(requestedVolumeID)
+
 	if vol, err := d.PVClient.Get(ctx, requestedVolumeID, v1.GetOptions{}); err == nil {
+		// The PV holds the context of the first create, including the ownership and the negotiated dialect
+		if vol.Spec.CSI != nil && vol.Spec.CSI.VolumeAttributes != nil {
+			volumeContext = vol.Spec.CSI.VolumeAttributes
+		}
 		return &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
 				VolumeId: vol.GetName(),
-				VolumeContext: requestParameters,
+				VolumeContext: volumeContext,
 				ContentSource: requestContentSource,
 			},
 		}, nil
@@ -51,28 +80,44 @@ func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId: requestedVolumeID,
-			VolumeContext: requestParameters,
+			VolumeContext: volumeContext,
 			CapacityBytes: requestCapacity,
 		},
 	}
 
-	serverSharePath := "//" + strings.Join([]string{server, share}, "/")
-	localSharePath := filepath.Join(driverStateDir, share)
-	localVolumePath := filepath.Join(localSharePath, requestedVolumeID)
-
-	if err := d.Mounter.AuthMount(serverSharePath, localSharePath, request.GetSecrets(), nil); err != nil {
-		klog.Infof("Failed: %s", err.Error())
+	localSharePath, releaseShare, smbVersion, err := d.acquireShare(ctx, server, share, request.GetSecrets(), requestParameters, nil)
+	if err != nil {
+		logging.FromContext(ctx, "controller").Error(err, "Acquiring share failed", "server", server, "share", share)
 		return nil, err
 	}
+	defer releaseShare()
+	localVolumePath := filepath.Join(localSharePath, subDir)
+
+	// The nodes try the dialect which worked here first
+	if isAutoSMBVersion(requestParameters) {
+		volumeContext[negotiatedSMBVersionKey] = smbVersion
+	}
 
-	if err := d.Mounter.CreateDir(localVolumePath, os.ModeDir); err != nil {
-		klog.Infof("Failed: %s", err.Error())
+	if err := d.Mounter.CreateDir(localVolumePath, permissions.Mode); err != nil {
+		logging.FromContext(ctx, "controller").Error(err, "Creating volume directory failed", "path", localVolumePath)
 		return nil, err
 	}
+	// Two volumes must never share a directory, e.g. if the subDirPattern leaves out the pv name.
+	// The directory is claimed first, so the permissions of another volume's directory are never changed.
+	if err := claimVolumeDir(localSharePath, subDir, requestedVolumeID); err != nil {
+		logging.FromContext(ctx, "controller").Error(err, "Claiming volume directory failed", "path", localVolumePath)
+		return nil, err
+	}
+	volumeContext[ownershipKey] = d.applyDirPermissions(localVolumePath, permissions)
 
 	switch requestContentSource.GetType().(type) {
 	case *csi.VolumeContentSource_Snapshot:
 		snapID := requestContentSource.GetSnapshot().GetSnapshotId()
+		// The snapshot must not be deleted while it gets extracted
+		if err := d.snapshotLocks.Acquire(snapID, "CreateVolume"); err != nil {
+			return nil, err
+		}
+		defer d.snapshotLocks.Release(snapID)
 		snap, err := d.RestClient.Resource(schema.GroupVersionResource{
 			Group: "snapshot.storage.k8s.io",
 			Resource: "volumesnapshotcontents",
@@ -91,22 +136,27 @@ func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 
 		rollbackServer := rollbackPV.Spec.CSI.VolumeAttributes["server"]
 		rollbackShare := rollbackPV.Spec.CSI.VolumeAttributes["share"]
+		rollbackSubDir := volumeSubDir(rollbackVolID, rollbackPV.Spec.CSI.VolumeAttributes)
 
-		rollbackServerVolumePath := "//" + strings.Join([]string{rollbackServer, rollbackShare, rollbackVolID}, "/")
-		rollbackLocalSharePath := filepath.Join(driverStateDir, share)
-		rollbackLocalVolumePath := filepath.Join(rollbackLocalSharePath, rollbackVolID)
-
-
-		if rollbackShare != share {
-			if err := d.Mounter.AuthMount(rollbackServerVolumePath, rollbackLocalVolumePath, request.GetSecrets(), nil); err != nil {
-				klog.Infof("Failed: %s", err.Error())
-				break
-			}
+		// Same share and credentials borrow the mount which is already in use
+		rollbackLocalSharePath, releaseRollbackShare, _, err := d.acquireShare(ctx, rollbackServer, rollbackShare, request.GetSecrets(), rollbackPV.Spec.CSI.VolumeAttributes, nil)
+		if err != nil {
+			logging.FromContext(ctx, "controller").Error(err, "Acquiring share of the snapshot failed", "server", rollbackServer, "share", rollbackShare)
+			break
 		}
+		defer releaseRollbackShare()
+		rollbackLocalVolumePath := filepath.Join(rollbackLocalSharePath, rollbackSubDir)
 
 		snapFile := fmt.Sprintf("%s/%s.snap", rollbackLocalVolumePath, snapID)
-		if err := snapshotter.ExtractSnap(snapFile, localVolumePath); err != nil {
-			klog.Infof("Failed: %s", err.Error())
+		var snapSize int64 = 0
+		if fi, err := os.Stat(snapFile); err == nil {
+			snapSize = fi.Size()
+		}
+		restoreStarted := time.Now()
+		err = snapshotter.ExtractSnap(ctx, snapFile, localVolumePath)
+		metrics.ObserveSnapshot("restore", restoreStarted, snapSize, err)
+		if err != nil {
+			logging.FromContext(ctx, "controller").Error(err, "Restoring snapshot failed", "snapFile", snapFile)
 			break
 		}
 
@@ -119,30 +169,45 @@ func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 		}
 	case *csi.VolumeContentSource_Volume:
 		rollbackVolID := requestContentSource.GetVolume().GetVolumeId()
+		if err := d.volumeLocks.Acquire(rollbackVolID, "CreateVolume"); err != nil {
+			return nil, err
+		}
+		defer d.volumeLocks.Release(rollbackVolID)
 		rollbackPV, err := d.PVClient.Get(ctx, rollbackVolID, v1.GetOptions{})
 		if err != nil {
 			break
 		}
 		rollbackServer := rollbackPV.Spec.CSI.VolumeAttributes["server"]
 		rollbackShare := rollbackPV.Spec.CSI.VolumeAttributes["share"]
+		rollbackSubDir := volumeSubDir(rollbackVolID, rollbackPV.Spec.CSI.VolumeAttributes)
 
-		rollbackServerVolumePath := "//" + strings.Join([]string{rollbackServer, rollbackShare, rollbackVolID}, "/")
-		rollbackLocalVolumePath := filepath.Join(driverStateDir, share, rollbackVolID)
-
-		if rollbackShare != share {
-			if err := d.Mounter.AuthMount(rollbackServerVolumePath, rollbackLocalVolumePath, request.GetSecrets(), nil); err != nil {
-				klog.Infof("Failed: %s", err.Error())
-				break
-			}
-		}
-
-		if err := copy.Copy(rollbackLocalVolumePath, localVolumePath); err != nil {
-			klog.Infof("Failed populating Volume with other Volumestate: %s", err.Error())
+		rollbackLocalSharePath, releaseRollbackShare, _, err := d.acquireShare(ctx, rollbackServer, rollbackShare, request.GetSecrets(), rollbackPV.Spec.CSI.VolumeAttributes, nil)
+		if err != nil {
+			logging.FromContext(ctx, "controller").Error(err, "Acquiring share of the source volume failed", "server", rollbackServer, "share", rollbackShare)
 			break
 		}
-
-		if err := d.Mounter.Unmount(rollbackLocalVolumePath); err != nil {
-			klog.Infof("failed unmounting local rollback vol path: %s", err.Error())
+		defer releaseRollbackShare()
+		rollbackLocalVolumePath := filepath.Join(rollbackLocalSharePath, rollbackSubDir)
+
+		// Every copied path passes the skip check, which sums up the bytes of the clone
+		var cloneSize int64 = 0
+		sumCloneSize := copy.Options{
+			Skip: func(src string) (bool, error) {
+				if fi, err := os.Lstat(src); err == nil && fi.Mode().IsRegular() {
+					cloneSize += fi.Size()
+				}
+				return false, nil
+			},
+		}
+		cloneStarted := time.Now()
+		_, cloneSpan := tracing.Start(ctx, "clone volume", attribute.String("sourceVolumeID", rollbackVolID))
+		err = copy.Copy(rollbackLocalVolumePath, localVolumePath, sumCloneSize)
+		cloneSpan.SetAttributes(attribute.Int64("bytes", cloneSize))
+		tracing.End(cloneSpan, err)
+		metrics.ObserveSnapshot("clone", cloneStarted, cloneSize, err)
+		if err != nil {
+			logging.FromContext(ctx, "controller").Error(err, "Cloning volume failed", "sourceVolumeID", rollbackVolID)
+			break
 		}
 
 		resp.Volume.ContentSource = &csi.VolumeContentSource{
@@ -156,21 +221,29 @@ func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 		break
 	}
 
-	_ = d.Mounter.Unmount(localSharePath)
-
 	return resp, nil
 }
 
 func (d *Driver) DeleteVolume(ctx context.Context, request *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+
+	if err := d.volumeLocks.Acquire(request.GetVolumeId(), "DeleteVolume"); err != nil {
+		return nil, err
+	}
+	defer d.volumeLocks.Release(request.GetVolumeId())
+
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
 func (d *Driver) ControllerPublishVolume(ctx context.Context, request *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 
 	volumeId := request.GetVolumeId()
+	nodeID := request.GetNodeId()
 	volumeContext := request.GetVolumeContext()
 	secrets := request.GetSecrets()
-	mountFlags := request.GetVolumeCapability().GetMount().GetMountFlags()
+
+	if nodeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "No Node ID present")
+	}
 
 	// Check if source path is present
 	server, isServerPresent := volumeContext["server"]
@@ -183,35 +256,95 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, request *csi.Contr
 		return nil, status.Error(codes.InvalidArgument,"No smb-share source is present")
 	}
 
-	sourceMountPoint := "//" + strings.Join([]string{server, share}, "/")
+	permissions, err := parseDirPermissions(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	mountFlags, err := d.validateMountFlags(request.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSecurityMode(volumeContext, mountFlags, secrets); err != nil {
+		return nil, err
+	}
 
-	if err := d.Mounter.AuthMount(sourceMountPoint, filepath.Join(d.StateDir, share), secrets, mountFlags); err != nil {
-		klog.Infof("Failed: %s", err.Error())
+	if err := d.volumeLocks.Acquire(volumeId, "ControllerPublishVolume"); err != nil {
 		return nil, err
 	}
+	defer d.volumeLocks.Release(volumeId)
 
-	if err := d.Mounter.CreateDir(filepath.Join(d.StateDir, share, volumeId), os.ModeDir); err != nil {
+	if err := d.attachVolume(ctx, volumeId, nodeID, request.GetVolumeCapability().GetAccessMode().GetMode()); err != nil {
+		logging.FromContext(ctx, "controller").Error(err, "Attaching volume failed")
 		return nil, err
 	}
 
-	_ = d.Mounter.Unmount(filepath.Join(d.StateDir, share))
+	if err := d.ensureVolumeDir(ctx, volumeId, server, share, secrets, volumeContext, mountFlags, permissions); err != nil {
+		// The node does not use the volume, so it must not keep another node from publishing it
+		if detachErr := d.detachVolume(ctx, volumeId, nodeID); detachErr != nil {
+			logging.FromContext(ctx, "controller").Error(detachErr, "Detaching volume failed")
+		}
+		return nil, err
+	}
 
 	return &csi.ControllerPublishVolumeResponse{}, nil
 }
 
+// ensureVolumeDir creates the volume directory again if it was removed from the share
+func (d *Driver) ensureVolumeDir(ctx context.Context, volumeId string, server string, share string, secrets map[string]string, volumeContext map[string]string, mountFlags []string, permissions *dirPermissions) error {
+
+	localSharePath, releaseShare, _, err := d.acquireShare(ctx, server, share, secrets, volumeContext, mountFlags)
+	if err != nil {
+		logging.FromContext(ctx, "controller").Error(err, "Acquiring share failed", "server", server, "share", share)
+		return err
+	}
+	defer releaseShare()
+	subDir := volumeSubDir(volumeId, volumeContext)
+	localVolumePath := filepath.Join(localSharePath, subDir)
+
+	// Only a directory created here gets the requested permissions, existing ones are left untouched
+	if !d.Mounter.PathExists(localVolumePath) {
+		if err := d.Mounter.CreateDir(localVolumePath, permissions.Mode); err != nil {
+			return err
+		}
+		// The recreated directory is claimed like a new one, so it can never end up shared with another volume
+		if err := claimVolumeDir(localSharePath, subDir, volumeId); err != nil {
+			logging.FromContext(ctx, "controller").Error(err, "Claiming recreated volume directory failed", "path", localVolumePath)
+			return err
+		}
+		if ownership := d.applyDirPermissions(localVolumePath, permissions); ownership != volumeContext[ownershipKey] {
+			logging.FromContext(ctx, "controller").Info("Recreated volume directory, but ownership could only be applied on the "+ownership, "path", localVolumePath)
+		}
+	}
+	return nil
+}
+
 func (d *Driver) ControllerUnpublishVolume(ctx context.Context, request *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 
 	volumeID := request.GetVolumeId()
-
-	pv, err := d.PVClient.Get(ctx, volumeID, v1.GetOptions{})
-	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument,"Cannot find Volume with ID: %s", volumeID)
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "No Volume ID present")
 	}
 
-	share := pv.Spec.CSI.VolumeAttributes["share"]
+	if err := d.volumeLocks.Acquire(volumeID, "ControllerUnpublishVolume"); err != nil {
+		return nil, err
+	}
+	defer d.volumeLocks.Release(volumeID)
 
-	_ = d.Mounter.Unmount(filepath.Join(d.StateDir, share, volumeID))
+	// Without a node ID the volume has to be unpublished from all nodes
+	var err error
+	if request.GetNodeId() == "" {
+		err = d.updateAttachedNodes(ctx, volumeID, func(nodes []string) ([]string, error) { return []string{}, nil })
+	} else {
+		err = d.detachVolume(ctx, volumeID, request.GetNodeId())
+	}
+	// A volume which does not exist anymore is not published anywhere, the CSI spec requires OK for it
+	if status.Code(err) == codes.NotFound {
+		logging.FromContext(ctx, "controller").Info("Volume does not exist anymore, treating it as unpublished")
+	} else if err != nil {
+		return nil, err
+	}
 
+	// The share mounts of the controller are released by the share mount manager, nothing is left to unmount here
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
@@ -224,6 +357,8 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, request *csi.Va
 		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
 	}
 
 	var supportedCaps []*csi.VolumeCapability
@@ -283,6 +418,7 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, request *csi.Con
 		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 	}
 
 	var capabilityObjects []*csi.ControllerServiceCapability
@@ -309,6 +445,11 @@ func (d *Driver) CreateSnapshot(ctx context.Context, request *csi.CreateSnapshot
 	requestName := request.GetName()
 	secrets := request.GetSecrets()
 
+	if err := d.snapshotLocks.Acquire(requestName, "CreateSnapshot"); err != nil {
+		return nil, err
+	}
+	defer d.snapshotLocks.Release(requestName)
+
 	// Return existing Snapshot if one exists
 	// No other possibility known to request existing volumesnapshots, because go-client has no snapshot support
 	// Will not work with Version v1beta1 or v1alpha1, thus only use API-version v1 to create snapshots
@@ -339,6 +480,12 @@ func (d *Driver) CreateSnapshot(ctx context.Context, request *csi.CreateSnapshot
 		}, nil
 	}
 
+	// Snapshots of the same volume write into the same volume directory
+	if err := d.volumeLocks.Acquire(requestVolID, "CreateSnapshot"); err != nil {
+		return nil, err
+	}
+	defer d.volumeLocks.Release(requestVolID)
+
 	pv, err := d.PVClient.Get(ctx, requestVolID, v1.GetOptions{})
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Cannot find requested PV with id: %s", requestVolID)
@@ -346,27 +493,30 @@ func (d *Driver) CreateSnapshot(ctx context.Context, request *csi.CreateSnapshot
 	volShare := pv.Spec.CSI.VolumeAttributes["share"]
 	volServer := pv.Spec.CSI.VolumeAttributes["server"]
 	volID := pv.GetName()
-	volPath := filepath.Join(driverStateDir, volShare, volID)
+	volSubDir := volumeSubDir(volID, pv.Spec.CSI.VolumeAttributes)
 
-	sourceVolumePoint := "//" + strings.Join([]string{volServer, volShare, volID}, "/")
-
-	if err := d.Mounter.AuthMount(sourceVolumePoint, volPath, secrets, nil); err != nil {
-		klog.Infof("Failed: %s", err.Error())
+	localSharePath, releaseShare, _, err := d.acquireShare(ctx, volServer, volShare, secrets, pv.Spec.CSI.VolumeAttributes, nil)
+	if err != nil {
+		logging.FromContext(ctx, "controller").Error(err, "Acquiring share failed", "server", volServer, "share", volShare)
 		return nil, err
 	}
+	defer releaseShare()
+	volPath := filepath.Join(localSharePath, volSubDir)
 
 	snapshotID := requestName
 	createdTime := timestamppb.Now()
 	var snapSize int64 = 0
 	snapFile := filepath.Join(volPath, snapshotID) + ".snap"
-	if err := snapshotter.CreateSnapshot(volPath, snapFile); err != nil {
-		return nil, err
-	}
-	if fi, err := os.Stat(snapFile); err == nil {
-		snapSize = fi.Size()
+	snapshotStarted := time.Now()
+	err = snapshotter.CreateSnapshot(ctx, volPath, snapFile)
+	if err == nil {
+		if fi, statErr := os.Stat(snapFile); statErr == nil {
+			snapSize = fi.Size()
+		}
 	}
-	if err := d.Mounter.Unmount(volPath); err != nil {
-		klog.Infof("Failed unmounting: %s", err.Error())
+	metrics.ObserveSnapshot("snapshot", snapshotStarted, snapSize, err)
+	if err != nil {
+		return nil, err
 	}
 
 	return &csi.CreateSnapshotResponse{
@@ -385,6 +535,11 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, request *csi.DeleteSnapshot
 	requestSnapID := request.GetSnapshotId()
 	secrets := request.GetSecrets()
 
+	if err := d.snapshotLocks.Acquire(requestSnapID, "DeleteSnapshot"); err != nil {
+		return nil, err
+	}
+	defer d.snapshotLocks.Release(requestSnapID)
+
 	snap, snapErr := d.RestClient.Resource(schema.GroupVersionResource{
 		Group: "snapshot.storage.k8s.io",
 		Resource: "volumesnapshotcontents",
@@ -396,6 +551,12 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, request *csi.DeleteSnapshot
 
 	spec := snap.Object["spec"].(map[string]interface{})
 	volID := spec["source"].(map[string]interface{})["volumeHandle"].(string)
+
+	if err := d.volumeLocks.Acquire(volID, "DeleteSnapshot"); err != nil {
+		return nil, err
+	}
+	defer d.volumeLocks.Release(volID)
+
 	volume, err := d.PVClient.Get(ctx, volID, v1.GetOptions{})
 	if err != nil {
 		// Referenced volume not found or already deleted, nothing to do
@@ -405,19 +566,17 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, request *csi.DeleteSnapshot
 	requestVolID := volume.GetName()
 	share := volume.Spec.CSI.VolumeAttributes["share"]
 	server := volume.Spec.CSI.VolumeAttributes["server"]
-	path := filepath.Join(driverStateDir, share, volID)
-	sourceVolumePoint := "//" + strings.Join([]string{server, share, requestVolID}, "/")
+	subDir := volumeSubDir(requestVolID, volume.Spec.CSI.VolumeAttributes)
 
-	if err := d.Mounter.AuthMount(sourceVolumePoint, path, secrets, nil); err != nil {
-		klog.Infof("Failed: %s", err.Error())
+	localSharePath, releaseShare, _, err := d.acquireShare(ctx, server, share, secrets, volume.Spec.CSI.VolumeAttributes, nil)
+	if err != nil {
+		logging.FromContext(ctx, "controller").Error(err, "Acquiring share failed", "server", server, "share", share)
 		return nil, err
 	}
+	defer releaseShare()
+	path := filepath.Join(localSharePath, subDir)
 
-	if err := snapshotter.DeleteSnapshot(filepath.Join(path, requestSnapID) + ".snap"); err != nil { return &csi.DeleteSnapshotResponse{}, nil }
-
-	if err := d.Mounter.Unmount(path); err != nil {
-		klog.Infof("Failed unmounting: %s", err.Error())
-	}
+	if err := snapshotter.DeleteSnapshot(ctx, filepath.Join(path, requestSnapID) + ".snap"); err != nil { return &csi.DeleteSnapshotResponse{}, nil }
 
 	return &csi.DeleteSnapshotResponse{}, nil
 }
@@ -0,0 +1,167 @@
+package dfs
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Referral cache of the kernel, available since Linux 5.5
+const referralCachePath = "/proc/fs/cifs/dfscache"
+
+// Referral is an entry of the referral cache of the kernel: a DFS path and the share targets it refers to
+type Referral struct {
+	// DFS path like //corp.example/dfs/team
+	Path string
+	// Targets like //fs1/team, the one the kernel currently uses first
+	Targets []string
+	Expired bool
+}
+
+// Resolver caches the targets DFS paths were resolved to by the kernel.
+// The controller uses them to mount the target directly, without a referral round trip for every share mount
+// and while the namespace servers are unavailable.
+type Resolver struct {
+	ttl time.Duration
+
+	mutex   sync.Mutex
+	targets map[string]cachedTarget
+}
+
+type cachedTarget struct {
+	target  string
+	expires time.Time
+}
+
+func NewResolver(ttl time.Duration) *Resolver {
+	return &Resolver{
+		ttl:     ttl,
+		targets: make(map[string]cachedTarget),
+	}
+}
+
+// Lookup returns the cached target of a cifs source, or false if the source was not resolved or the target expired
+func (r *Resolver) Lookup(source string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	cached, isCached := r.targets[normalize(source)]
+	if !isCached || time.Now().After(cached.expires) {
+		return "", false
+	}
+	return cached.target, true
+}
+
+// Learn records the target the kernel resolved the mounted source to. A source which is no DFS path is ignored.
+func (r *Resolver) Learn(source string) {
+	referrals, err := ListReferrals()
+	if err != nil {
+		return
+	}
+	target, isResolved := Resolve(referrals, source)
+	if !isResolved {
+		return
+	}
+
+	r.Record(source, target)
+}
+
+// Record caches the target of a source for the ttl of the resolver
+func (r *Resolver) Record(source string, target string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.targets[normalize(source)] = cachedTarget{target: normalize(target), expires: time.Now().Add(r.ttl)}
+}
+
+// Forget drops the target of a source, e.g. after mounting the target failed
+func (r *Resolver) Forget(source string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.targets, normalize(source))
+}
+
+// ListReferrals reads the referral cache of the kernel
+func ListReferrals() ([]Referral, error) {
+	file, err := os.Open(referralCachePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseReferralCache(file)
+}
+
+// ParseReferralCache parses the format of /proc/fs/cifs/dfscache:
+//
+//	cache entry: path=\corp.example\dfs\team,type=LINK,ttl=300,...,expired=no
+//	  \fs1\team (target hint)
+//	  \fs2\team
+func ParseReferralCache(reader io.Reader) ([]Referral, error) {
+	var referrals []Referral
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "cache entry:") {
+			referral := Referral{}
+			for _, field := range strings.Split(strings.TrimSpace(strings.TrimPrefix(trimmed, "cache entry:")), ",") {
+				if strings.HasPrefix(field, "path=") {
+					referral.Path = normalize(strings.TrimPrefix(field, "path="))
+				} else if field == "expired=yes" {
+					referral.Expired = true
+				}
+			}
+			referrals = append(referrals, referral)
+			continue
+		}
+
+		// Targets are indented below their entry
+		if len(referrals) == 0 || !strings.HasPrefix(line, " ") || !strings.HasPrefix(trimmed, `\`) {
+			continue
+		}
+		current := &referrals[len(referrals)-1]
+		target := normalize(strings.Fields(trimmed)[0])
+		if strings.HasSuffix(trimmed, "(target hint)") {
+			current.Targets = append([]string{target}, current.Targets...)
+		} else {
+			current.Targets = append(current.Targets, target)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return referrals, nil
+}
+
+// Resolve returns the target of the source from the longest DFS path in the referrals the source starts with.
+// The part of the source below the DFS path is appended to the target.
+func Resolve(referrals []Referral, source string) (string, bool) {
+	source = normalize(source)
+	var best *Referral
+	for index := range referrals {
+		referral := &referrals[index]
+		if referral.Expired || len(referral.Targets) == 0 || !isBelow(source, referral.Path) {
+			continue
+		}
+		if best == nil || len(referral.Path) > len(best.Path) {
+			best = referral
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.Targets[0] + source[len(best.Path):], true
+}
+
+func isBelow(source string, path string) bool {
+	return strings.EqualFold(source, path) || strings.HasPrefix(strings.ToLower(source), strings.ToLower(path)+"/")
+}
+
+// normalize writes a UNC path like \server\share or //server/share/ as //server/share
+func normalize(path string) string {
+	path = strings.Trim(strings.Replace(path, `\`, "/", -1), "/")
+	return "//" + path
+}
@@ -0,0 +1,85 @@
+package dfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// /proc/fs/cifs/dfscache as written by fs/cifs/dfs_cache.c for a domain based namespace, plus some garbage
+const referralCache = `DFS cache
+---------
+cache entry: path=\corp.example\dfs,type=root,ttl=300,etime=538412345,hdr_flags=0x3,ref_flags=0x0,interlink=no,path_consumed=17,expired=no
+  \dc1.corp.example\dfs (target hint)
+  \dc2.corp.example\dfs
+cache entry: path=\corp.example\dfs\team,type=link,ttl=1800,etime=112093870,hdr_flags=0x2,ref_flags=0x0,interlink=no,path_consumed=22,expired=no
+  \fs1.corp.example\team
+  \fs2.corp.example\team (target hint)
+cache entry: path=\corp.example\dfs\archive,type=link,ttl=300,etime=904417212,hdr_flags=0x2,ref_flags=0x0,interlink=no,path_consumed=25,expired=yes
+  \fs3.corp.example\archive (target hint)
+cache entry: path=\corp.example\dfs\empty,type=link,ttl=300,etime=112093870,hdr_flags=0x2,ref_flags=0x0,interlink=no,path_consumed=23,expired=no
+garbage without indentation
+  garbage without a backslash
+`
+
+func TestParseReferralCache(t *testing.T) {
+	referrals, err := ParseReferralCache(strings.NewReader(referralCache))
+	assert.NoError(t, err)
+	assert.Equal(t, []Referral{
+		{Path: "//corp.example/dfs", Targets: []string{"//dc1.corp.example/dfs", "//dc2.corp.example/dfs"}},
+		{Path: "//corp.example/dfs/team", Targets: []string{"//fs2.corp.example/team", "//fs1.corp.example/team"}},
+		{Path: "//corp.example/dfs/archive", Targets: []string{"//fs3.corp.example/archive"}, Expired: true},
+		{Path: "//corp.example/dfs/empty"},
+	}, referrals)
+}
+
+func TestParseReferralCache_TargetsBeforeFirstEntryAreIgnored(t *testing.T) {
+	referrals, err := ParseReferralCache(strings.NewReader("  \\fs1\\team (target hint)\n\ncache entry: path=\\dfs\\team,expired=no\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []Referral{{Path: "//dfs/team"}}, referrals)
+}
+
+func TestResolve(t *testing.T) {
+	referrals, err := ParseReferralCache(strings.NewReader(referralCache))
+	assert.NoError(t, err)
+
+	for _, test := range []struct {
+		source     string
+		target     string
+		isResolved bool
+	}{
+		// The longest path wins and the target hint is used
+		{"//corp.example/dfs/team", "//fs2.corp.example/team", true},
+		{"//corp.example/dfs/team/project", "//fs2.corp.example/team/project", true},
+		{"//CORP.example/dfs/Team", "//fs2.corp.example/team", true},
+		{"//corp.example/dfs/other", "//dc1.corp.example/dfs/other", true},
+		// Expired entries and entries without targets fall back to the root
+		{"//corp.example/dfs/archive", "//dc1.corp.example/dfs/archive", true},
+		{"//corp.example/dfs/empty", "//dc1.corp.example/dfs/empty", true},
+		// A common prefix is no parent path
+		{"//corp.example/dfsx", "", false},
+		{"//fs1/share", "", false},
+	} {
+		target, isResolved := Resolve(referrals, test.source)
+		assert.Equal(t, test.isResolved, isResolved, test.source)
+		assert.Equal(t, test.target, target, test.source)
+	}
+}
+
+func TestResolver_RecordedTargetExpires(t *testing.T) {
+	resolver := NewResolver(time.Hour)
+	resolver.Record(`\corp.example\dfs\team`, `\fs1\team`)
+	target, isCached := resolver.Lookup("//corp.example/dfs/team/")
+	assert.True(t, isCached)
+	assert.Equal(t, "//fs1/team", target)
+
+	resolver.Forget("//corp.example/dfs/team")
+	_, isCached = resolver.Lookup("//corp.example/dfs/team")
+	assert.False(t, isCached)
+
+	expiring := NewResolver(-time.Second)
+	expiring.Record("//corp.example/dfs/team", "//fs1/team")
+	_, isCached = expiring.Lookup("//corp.example/dfs/team")
+	assert.False(t, isCached)
+}
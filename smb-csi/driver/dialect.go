@@ -0,0 +1,176 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/mounter"
+	"smb-csi/driver/tracing"
+	"strings"
+)
+
+const (
+	// StorageClass parameter pinning the SMB dialect or negotiating it with auto
+	smbVersionKey  = "smbVersion"
+	smbVersionAuto = "auto"
+	// Volume context key recording the dialect negotiated when the volume was created
+	negotiatedSMBVersionKey = "negotiatedSMBVersion"
+
+	// Dialect used if the StorageClass does not set one
+	defaultSMBVersion = "3.0"
+)
+
+// Dialects understood by the vers option of mount.cifs
+var smbVersions = []string{"1.0", "2.0", "2.1", "3.0", "3.02", "3.1.1"}
+
+// Dialects tried in order with smbVersion auto
+var autoSMBVersions = []string{"3.1.1", "3.0", "2.1"}
+
+// Dialects without encryption, which is only available since SMB 3.0
+var unencryptedSMBVersions = map[string]bool{"1.0": true, "2.0": true, "2.1": true}
+
+// smbVersionCandidates returns the dialects to try in order for the smbVersion of the StorageClass or volume context.
+// With auto, the dialect negotiated before is tried first. requireEncryption leaves out the dialects before SMB 3.0.
+func smbVersionCandidates(parameters map[string]string) ([]string, error) {
+	candidates, err := configuredSMBVersions(parameters)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := parseTransportSecurity(parameters)
+	if err != nil || !transport.Encryption {
+		return candidates, err
+	}
+
+	var encrypted []string
+	for _, candidate := range candidates {
+		if !unencryptedSMBVersions[candidate] {
+			encrypted = append(encrypted, candidate)
+		}
+	}
+	if len(encrypted) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "smbVersion %s does not support encryption, which requireEncryption requires", parameters[smbVersionKey])
+	}
+	return encrypted, nil
+}
+
+func configuredSMBVersions(parameters map[string]string) ([]string, error) {
+	version, isVersionPresent := parameters[smbVersionKey]
+	if !isVersionPresent || version == "" {
+		return []string{defaultSMBVersion}, nil
+	}
+
+	if strings.ToLower(version) == smbVersionAuto {
+		candidates := autoSMBVersions
+		if negotiated, isNegotiatedPresent := parameters[negotiatedSMBVersionKey]; isNegotiatedPresent && isSMBVersion(negotiated) {
+			candidates = []string{negotiated}
+			for _, candidate := range autoSMBVersions {
+				if candidate != negotiated {
+					candidates = append(candidates, candidate)
+				}
+			}
+		}
+		return candidates, nil
+	}
+
+	if !isSMBVersion(version) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid smbVersion %s, must be %s or one of %s", version, smbVersionAuto, strings.Join(smbVersions, ", "))
+	}
+	return []string{version}, nil
+}
+
+func isSMBVersion(version string) bool {
+	for _, known := range smbVersions {
+		if version == known {
+			return true
+		}
+	}
+	return false
+}
+
+// isAutoSMBVersion reports if the dialect is negotiated instead of pinned
+func isAutoSMBVersion(parameters map[string]string) bool {
+	return strings.ToLower(parameters[smbVersionKey]) == smbVersionAuto
+}
+
+func hasVersOption(mountFlags []string) bool {
+	for _, flag := range mountFlags {
+		if strings.HasPrefix(flag, "vers=") {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateSMBVersion mounts with the vers option of each candidate until one succeeds and returns its dialect.
+// It only falls back to the next dialect if the server rejected the previous one, so a wrong password
+// is not tried again with every dialect. A vers option in the mount flags takes precedence over the candidates.
+func negotiateSMBVersion(ctx context.Context, candidates []string, mountFlags []string, mount func(mountFlags []string) error) (string, error) {
+
+	for _, flag := range mountFlags {
+		if strings.HasPrefix(flag, "vers=") {
+			return strings.TrimPrefix(flag, "vers="), mount(mountFlags)
+		}
+	}
+
+	var err error
+	for _, version := range candidates {
+		err = mount(append([]string{fmt.Sprintf("vers=%s", version)}, mountFlags...))
+		if err == nil {
+			return version, nil
+		}
+		if !mounter.IsDialectError(err) {
+			return "", err
+		}
+		logging.FromContext(ctx, "mounter").Info("SMB dialect was rejected", "version", version, "err", err)
+	}
+	return "", err
+}
+
+// acquireShare borrows a share mount of the controller for a volume,
+// using the sec and smbVersion of the StorageClass parameters or volume context.
+// It returns the local path of the share, the function releasing it and the dialect of the mount.
+// A share given as DFS path is mounted from the target it was last resolved to, as long as that one is reachable.
+func (d *Driver) acquireShare(ctx context.Context, server string, share string, secrets map[string]string, volumeContext map[string]string, mountFlags []string) (string, func(), string, error) {
+	ctx, span := tracing.Start(ctx, "acquire share", attribute.String("server", server), attribute.String("share", share))
+	defer span.End()
+
+	shareFlags, err := shareMountFlags(volumeContext, mountFlags)
+	if err != nil {
+		return "", nil, "", err
+	}
+	candidates, err := smbVersionCandidates(volumeContext)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	var path string
+	var release func()
+	acquire := func(source string) (string, error) {
+		return negotiateSMBVersion(ctx, candidates, shareFlags, func(versionFlags []string) error {
+			var acquireErr error
+			path, release, acquireErr = d.ShareMounts.Acquire(ctx, source, secrets, versionFlags)
+			return acquireErr
+		})
+	}
+
+	source := mounter.CifsSource(server, share)
+	if target, isResolved := d.DFS.Lookup(source); isResolved {
+		version, err := acquire(target)
+		if err == nil {
+			return path, release, version, nil
+		}
+		logging.FromContext(ctx, "mounter").Info("Mounting DFS target failed, resolving it again", "target", target, "source", source, "err", err)
+		d.DFS.Forget(source)
+	}
+
+	version, err := acquire(source)
+	if err != nil {
+		return "", nil, "", err
+	}
+	// The kernel followed the referrals of a DFS path while mounting
+	d.DFS.Learn(source)
+	return path, release, version, nil
+}
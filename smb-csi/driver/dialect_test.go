@@ -0,0 +1,39 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNegotiateSMBVersion_OnlyFallsBackIfDialectIsRejected(t *testing.T) {
+	var tried []string
+	mount := func(rejected map[string]error) func([]string) error {
+		tried = nil
+		return func(mountFlags []string) error {
+			tried = append(tried, mountFlags[0])
+			return rejected[mountFlags[0]]
+		}
+	}
+
+	version, err := negotiateSMBVersion(context.Background(), autoSMBVersions, nil, mount(map[string]error{
+		"vers=3.1.1": errors.New("mount error(95): Operation not supported"),
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, "3.0", version)
+
+	badOption := errors.New("mount error(22): Invalid argument")
+	_, err = negotiateSMBVersion(context.Background(), autoSMBVersions, nil, mount(map[string]error{
+		"vers=3.1.1": badOption,
+	}))
+	assert.Equal(t, badOption, err)
+	assert.Equal(t, []string{"vers=3.1.1"}, tried)
+
+	unreachable := errors.New("mount error(112): Host is down")
+	_, err = negotiateSMBVersion(context.Background(), autoSMBVersions, nil, mount(map[string]error{
+		"vers=3.1.1": unreachable,
+	}))
+	assert.Equal(t, unreachable, err)
+	assert.Equal(t, []string{"vers=3.1.1"}, tried)
+}
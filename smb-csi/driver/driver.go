@@ -4,18 +4,35 @@ import (
 	"context"
 	"fmt"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	"net"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"smb-csi/driver/dfs"
+	"smb-csi/driver/healtchCheck"
+	"smb-csi/driver/journal"
+	"smb-csi/driver/kerberos"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/metrics"
 	"smb-csi/driver/mounter"
+	"smb-csi/driver/sealed"
+	"smb-csi/driver/sharemount"
+	"smb-csi/driver/tracing"
+	"smb-csi/driver/usage"
+	"time"
 )
 
 const (
@@ -25,43 +42,217 @@ const (
 )
 
 type Driver struct {
-	Name       string
-	Version    string
-	NodeID     string
-	StateDir   string
-	Mounter	   mounter.Mounter
-	PVClient   v1.PersistentVolumeInterface
-	RestClient dynamic.Interface
-	server     *grpc.Server
+	Name        string
+	Version     string
+	NodeID      string
+	StateDir    string
+	Mounter     mounter.Mounter
+	PVClient    v1.PersistentVolumeInterface
+	RestClient  dynamic.Interface
+	ShareMounts *sharemount.Manager
+	Kerberos    *kerberos.Manager
+	DFS         *dfs.Resolver
+	Usage       *usage.Tracker
+	Probes      *healtchCheck.Prober
+	Events      record.EventRecorder
+	// Stage and publish mounts of the node plugin, nil if they are not journaled
+	Journal     *journal.Journal
+	server      *grpc.Server
+
+	ephemeralVolumes  *ephemeralVolumes
+	stagedVolumes     *stagedVolumes
+	mountOptionPolicy *mounter.OptionPolicy
+	volumeLocks       *operationLocks
+	snapshotLocks     *operationLocks
+	// Latency above which the active probe reports a volume as slow, nil if the active probe is disabled
+	activeProbeSlowThreshold *time.Duration
+	// Seals the secrets of the staged volumes, which are needed to mount them again
+	secretBox *sealed.Box
+	stopWatch chan struct{}
+	// Flushes the spans which are not exported yet, nil if tracing is not set up
+	stopTracing func(context.Context) error
+}
+
+// Config holds the settings of the driver, passed on the command line
+type Config struct {
+	// Time after which an unused share mount of the controller is unmounted
+	ShareIdleTimeout time.Duration
+	// Host path for the Kerberos credential caches, mounted at the same path into the node plugin
+	Krb5CacheDir string
+	// Interval in which the Kerberos tickets of the staged volumes are renewed
+	Krb5RenewInterval time.Duration
+	// Mount options which may be set in the mountOptions of a StorageClass or PV
+	MountOptionsAllowlist []string
+	// Time the controller mounts the target a DFS path was resolved to, before resolving it again
+	DFSTargetTTL time.Duration
+	// Interval in which the usage of the published volumes is computed again
+	UsageRefreshInterval time.Duration
+	// Entries per second walked while computing the usage of a volume, 0 for no limit
+	UsageWalkRate int
+	// Time a walk computing the usage of a volume may take, it is abandoned afterwards
+	UsageWalkTimeout time.Duration
+	// Time a stat or statfs of a volume path may take before the volume is reported abnormal
+	ProbeTimeout time.Duration
+	// Probes running at the same time, each unresponsive mount blocks one of them until it responds again
+	ProbeWorkers int
+	// Check the volume condition by writing and reading back a hidden file in the volume
+	ActiveProbe bool
+	// Latency above which the active probe reports a volume as slow, 0 to not check it
+	ActiveProbeSlowThreshold time.Duration
+	// Interval in which the stage mounts are checked and mounted again if they are broken, 0 to not check them
+	RemountCheckInterval time.Duration
+	// Attempts to mount a broken stage mount again before giving up until it works again
+	RemountMaxAttempts int
+	// File of the node journal, which has to survive restarts of the node plugin, empty to not journal the mounts
+	JournalPath string
+	// Address the Prometheus metrics are served at, empty to not serve them
+	MetricsAddress string
+	// Mode of the driver, controller or node, which labels the metrics and traces.
+	// Only the node plugin journals its mounts and watches its stage mounts.
+	Mode string
+	// Exporter of the traces, otlp or file, empty to not trace the requests
+	TracingExporter string
+	// OTLP/gRPC endpoint of the otlp exporter, http://host:port for one without TLS, empty for OTEL_EXPORTER_OTLP_ENDPOINT
+	TracingEndpoint string
+	// File the file exporter appends the spans to
+	TracingFile string
+	// Format of the log lines, text or json
+	LogFormat string
+	// Verbosity of subsystems like mounter=5,snapshotter=2, the others log at the verbosity of -v
+	LogVerbosity string
 }
 
-func NewDriver(nodeID string) (*Driver, error) {
+func DefaultConfig() Config {
+	return Config{
+		ShareIdleTimeout:         5 * time.Minute,
+		Krb5CacheDir:             "/var/lib/kubelet/plugins/seitenbau.csi.smb/krb5",
+		Krb5RenewInterval:        time.Hour,
+		MountOptionsAllowlist:    mounter.DefaultMountOptionsAllowlist,
+		DFSTargetTTL:             5 * time.Minute,
+		UsageRefreshInterval:     time.Minute,
+		UsageWalkRate:            1000,
+		UsageWalkTimeout:         10 * time.Minute,
+		ProbeTimeout:             10 * time.Second,
+		ProbeWorkers:             8,
+		ActiveProbe:              false,
+		ActiveProbeSlowThreshold: 2 * time.Second,
+		RemountCheckInterval:     30 * time.Second,
+		RemountMaxAttempts:       5,
+		JournalPath:              "/var/lib/kubelet/plugins/seitenbau.csi.smb/node-journal.json",
+		MetricsAddress:           "",
+		Mode:                     "node",
+		TracingExporter:          "",
+		TracingEndpoint:          "",
+		TracingFile:              "/var/log/smb-csi-traces.json",
+		LogFormat:                "text",
+		LogVerbosity:             "",
+	}
+}
+
+// Mode of the node plugin, the controller has no stage mounts
+const nodeMode = "node"
+
+// New creates a driver without any Kubernetes clients, which are added by NewDriver
+func New(nodeID string, stateDir string, m mounter.Mounter, config Config) *Driver {
+	krb5 := kerberos.NewManager(config.Krb5CacheDir, config.Krb5RenewInterval)
+	secretBox, err := sealed.NewBox()
+	if err != nil {
+		klog.Fatalf("Failed creating the key for the secrets of the staged volumes: %s", err.Error())
+	}
+	probes := healtchCheck.NewProber(config.ProbeTimeout, config.ProbeWorkers)
+	shareMounts, err := sharemount.NewManager(m, krb5, probes, stateDir, config.ShareIdleTimeout)
+	if err != nil {
+		klog.Fatalf("Failed creating the key for the share mounts: %s", err.Error())
+	}
+	driver := &Driver{
+		Name:        driverName,
+		Version:     driverVersion,
+		StateDir:    stateDir,
+		Mounter:     m,
+		NodeID:      nodeID,
+		Kerberos:    krb5,
+		ShareMounts: shareMounts,
+		DFS:         dfs.NewResolver(config.DFSTargetTTL),
+		Usage:       usage.NewTracker(config.UsageRefreshInterval, config.UsageWalkTimeout, config.UsageWalkRate),
+		Probes:      probes,
+
+		ephemeralVolumes:  newEphemeralVolumes(),
+		stagedVolumes:     newStagedVolumes(),
+		mountOptionPolicy: mounter.NewOptionPolicy(config.MountOptionsAllowlist),
+		volumeLocks:       newOperationLocks("volume"),
+		snapshotLocks:     newOperationLocks("snapshot"),
+		secretBox:         secretBox,
+		stopWatch:         make(chan struct{}),
+	}
+	if config.ActiveProbe {
+		driver.activeProbeSlowThreshold = &config.ActiveProbeSlowThreshold
+	}
+	if config.Mode == nodeMode && config.RemountCheckInterval > 0 {
+		go driver.watchStageMounts(config.RemountCheckInterval, config.RemountMaxAttempts)
+	}
+	return driver
+}
+
+func NewDriver(nodeID string, config Config) (*Driver, error) {
+
+	if err := logging.Setup(config.LogFormat, config.LogVerbosity); err != nil {
+		klog.Infof("Error setting up logging: %s", err)
+		return nil, err
+	}
 
 	if stateDirErr := os.MkdirAll(driverStateDir, 0750); stateDirErr != nil {
 		klog.Infof("Error creating state directory: %s", stateDirErr)
 		return nil, stateDirErr
 	}
 
-	config, err := rest.InClusterConfig()
+	clusterConfig, err := rest.InClusterConfig()
 	if err != nil {
 		klog.Infof("Error creating cluster config: %s", err)
 	}
 
-	driver := &Driver{
-		Name:     driverName,
-		Version:  driverVersion,
-		StateDir: driverStateDir,
-		Mounter:  *mounter.NewMounter(),
+	driver := New(nodeID, driverStateDir, *mounter.NewMounter(), config)
+
+	stopTracing, err := tracing.Setup(tracing.Config{
+		Exporter: config.TracingExporter,
+		Endpoint: config.TracingEndpoint,
+		File:     config.TracingFile,
+		Mode:     config.Mode,
 		NodeID:   nodeID,
+	})
+	if err != nil {
+		klog.Infof("Error setting up tracing: %s", err)
+		return nil, err
+	}
+	driver.stopTracing = stopTracing
+	// The requests to the Kubernetes API are children of the request of the sidecar
+	if clusterConfig != nil {
+		clusterConfig.WrapTransport = tracing.WrapTransport
 	}
 
-	client, err := kubernetes.NewForConfig(config)
+	client, err := kubernetes.NewForConfig(clusterConfig)
 	pvClient := client.CoreV1().PersistentVolumes()
 	driver.PVClient = pvClient
 
-	restClient, _ := dynamic.NewForConfig(config)
+	restClient, _ := dynamic.NewForConfig(clusterConfig)
 	driver.RestClient = restClient
 
+	// Events about the volumes, e.g. when a broken stage mount was mounted again
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&v1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	driver.Events = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: driverName, Host: nodeID})
+
+	if err := driver.openJournal(config); err != nil {
+		klog.Infof("Error opening node journal %s: %s", config.JournalPath, err)
+		return nil, err
+	}
+
+	if config.MetricsAddress != "" {
+		if err := metrics.Serve(config.MetricsAddress, config.Mode); err != nil {
+			klog.Infof("Error serving metrics at %s: %s", config.MetricsAddress, err)
+			return nil, err
+		}
+	}
+
 	return driver, nil
 }
 
@@ -85,15 +276,31 @@ func (d *Driver) Run(endpoint string) error {
 		return fmt.Errorf("can't listen to: %v", err)
 	}
 
-	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	// Requests and responses are only logged with their secrets stripped
+	// Every request gets a correlation ID, which ties its log lines together and is added to its span
+	logHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		started := time.Now()
+		correlationID := logging.NewCorrelationID()
+		ctx = logging.WithFields(ctx, d.requestLogFields(correlationID, info.FullMethod, req)...)
+		log := logging.FromContext(ctx, "grpc")
+		log.V(4).Info("Request", "request", protosanitizer.StripSecrets(req))
+
+		ctx, span := tracing.StartRPC(ctx, info.FullMethod)
+		span.SetAttributes(attribute.String(logging.CorrelationIDKey, correlationID))
 		resp, err := handler(ctx, req)
+		tracing.EndRPC(span, err)
+		method := path.Base(info.FullMethod)
+		metrics.RPCRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+		metrics.RPCDuration.WithLabelValues(method).Observe(time.Since(started).Seconds())
 		if err != nil {
-			klog.Errorf("method: %s, error: %s", info.FullMethod, err)
+			log.Error(err, "Request failed", "code", status.Code(err).String(), "duration", time.Since(started).String())
+		} else {
+			log.V(5).Info("Response", "response", protosanitizer.StripSecrets(resp), "duration", time.Since(started).String())
 		}
 		return resp, err
 	}
 
-	d.server = grpc.NewServer(grpc.UnaryInterceptor(errHandler))
+	d.server = grpc.NewServer(grpc.UnaryInterceptor(logHandler))
 	csi.RegisterIdentityServer(d.server, d)
 	csi.RegisterControllerServer(d.server, d)
 	csi.RegisterNodeServer(d.server, d)
@@ -106,4 +313,13 @@ func (d *Driver) Run(endpoint string) error {
 func (d *Driver) Stop() {
 	klog.Info("Server Stopped!")
 	d.server.Stop()
+	d.ShareMounts.Stop()
+	d.Kerberos.Stop()
+	d.Usage.Stop()
+	close(d.stopWatch)
+	if d.stopTracing != nil {
+		if err := d.stopTracing(context.Background()); err != nil {
+			klog.Infof("Failed flushing the traces: %s", err.Error())
+		}
+	}
 }
@@ -0,0 +1,27 @@
+package driver
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenJournal_OnlyNodePluginJournals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.JournalPath = filepath.Join(dir, "node-journal.json")
+
+	config.Mode = "controller"
+	controller := &Driver{}
+	assert.NoError(t, controller.openJournal(config))
+	assert.Nil(t, controller.Journal)
+
+	config.Mode = nodeMode
+	node := &Driver{}
+	assert.NoError(t, node.openJournal(config))
+	assert.NotNil(t, node.Journal)
+}
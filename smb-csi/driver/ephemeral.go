@@ -0,0 +1,295 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"smb-csi/driver/journal"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/mounter"
+	"sync"
+)
+
+const (
+	// Set by kubelet in the volume context of CSI ephemeral inline volumes
+	ephemeralKey = "csi.storage.k8s.io/ephemeral"
+	// Directory below the state dir where the share of an ephemeral volume is mounted temporarily
+	ephemeralStateDir = "ephemeral"
+)
+
+// ephemeralVolume remembers what is needed to remove the scratch directory again at NodeUnpublishVolume.
+// The share stays mounted while the volume is published, so the scratch directory can be removed without
+// the secrets, which are not known anymore after a restart of the node plugin.
+type ephemeralVolume struct {
+	// Cifs source of the share, the scratch directory is named after the volume
+	Source string
+	// Mount point of the share
+	SharePath string
+	// Secrets to mount the share again if its mount is gone, nil for volumes published before a restart
+	SealedSecrets []byte
+	MountFlags    []string
+}
+
+type ephemeralVolumes struct {
+	mutex   sync.Mutex
+	volumes map[string]*ephemeralVolume
+}
+
+func newEphemeralVolumes() *ephemeralVolumes {
+	return &ephemeralVolumes{volumes: make(map[string]*ephemeralVolume)}
+}
+
+func (e *ephemeralVolumes) Get(volumeID string) (*ephemeralVolume, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	volume, isVolumePresent := e.volumes[volumeID]
+	return volume, isVolumePresent
+}
+
+func (e *ephemeralVolumes) Add(volumeID string, volume *ephemeralVolume) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.volumes[volumeID] = volume
+}
+
+func (e *ephemeralVolumes) Remove(volumeID string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.volumes, volumeID)
+}
+
+// ephemeralVolume returns the ephemeral volume published at the target path.
+// Volumes published before a restart of the node plugin are only known from the journal.
+func (d *Driver) ephemeralVolume(volumeID string, targetPath string) (*ephemeralVolume, bool) {
+	if volume, isEphemeralVolume := d.ephemeralVolumes.Get(volumeID); isEphemeralVolume {
+		return volume, true
+	}
+	if d.Journal == nil {
+		return nil, false
+	}
+	entry, isRecorded := d.Journal.Get(journal.KindEphemeral, targetPath)
+	if !isRecorded || entry.VolumeID != volumeID {
+		return nil, false
+	}
+	return &ephemeralVolume{Source: entry.Source, SharePath: entry.StagingPath}, true
+}
+
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[ephemeralKey] == "true"
+}
+
+// publishEphemeralVolume creates a scratch directory named after the volume on the share and mounts it at the target path.
+// Ephemeral volumes are never staged, so server, share and secret have to come with the publish request.
+func (d *Driver) publishEphemeralVolume(ctx context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+
+	volumeID := request.GetVolumeId()
+	targetPath := request.GetTargetPath()
+	volumeContext := request.GetVolumeContext()
+	secrets := request.GetSecrets()
+
+	if volumeID == "" { return nil, status.Error(codes.InvalidArgument, "No VolumeID specified") }
+	if targetPath == "" { return nil, status.Error(codes.InvalidArgument, "No Target Path Present") }
+
+	server, isServerPresent := volumeContext["server"]
+	if !isServerPresent {
+		return nil, status.Error(codes.InvalidArgument, "No smb-server source is present in the volume attributes")
+	}
+	share, isSharePresent := volumeContext["share"]
+	if !isSharePresent {
+		return nil, status.Error(codes.InvalidArgument, "No smb-share source is present in the volume attributes")
+	}
+
+	permissions, err := parseDirPermissions(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	mountFlags, err := d.validateMountFlags(request.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, err
+	}
+	// Kerberos tickets are only kept for staged volumes
+	if mode, err := mountSecurityMode(volumeContext, mountFlags); err != nil {
+		return nil, err
+	} else if mode == secKerberos {
+		return nil, status.Errorf(codes.InvalidArgument, "sec %s is not supported for ephemeral volumes", secKerberos)
+	}
+	if mountFlags, err = shareMountFlags(volumeContext, mountFlags); err != nil {
+		return nil, err
+	}
+	smbVersions, err := smbVersionCandidates(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.volumeLocks.Acquire(volumeID, "NodePublishVolume"); err != nil {
+		return nil, err
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	serverSharePath := mounter.CifsSource(server, share)
+	sourceMountPoint := mounter.CifsSource(server, share, volumeID)
+	localSharePath := filepath.Join(d.StateDir, ephemeralStateDir, volumeID)
+	localVolumePath := filepath.Join(localSharePath, volumeID)
+
+	if isPublished, err := d.isMountedFrom(targetPath, sourceMountPoint, mountFlags); err != nil {
+		return nil, err
+	} else if isPublished {
+		logging.FromContext(ctx, "node").Info("Ephemeral volume is already published", "path", targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	sealedSecrets, err := d.secretBox.Seal(secrets)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed sealing the secrets: %s", err.Error())
+	}
+
+	// A share mount left behind by a publish which failed half way
+	if isShareMounted, err := d.isMountedFrom(localSharePath, serverSharePath, nil); err != nil {
+		return nil, err
+	} else if isShareMounted {
+		d.releaseEphemeralShare(ctx, localSharePath)
+	}
+
+	smbVersion, err := negotiateSMBVersion(ctx, smbVersions, mountFlags, func(versionFlags []string) error {
+		return d.Mounter.AuthMount(ctx, serverSharePath, localSharePath, secrets, versionFlags)
+	})
+	if err != nil {
+		logging.FromContext(ctx, "node").Error(err, "Mounting share of ephemeral volume failed", "source", serverSharePath)
+		return nil, err
+	}
+	// The volume and a later mount of the share go straight to the negotiated dialect
+	if !hasVersOption(mountFlags) {
+		mountFlags = append([]string{fmt.Sprintf("vers=%s", smbVersion)}, mountFlags...)
+	}
+	if err := d.Mounter.CreateDir(localVolumePath, permissions.Mode); err != nil {
+		logging.FromContext(ctx, "node").Error(err, "Creating scratch directory of ephemeral volume failed", "path", localVolumePath)
+		d.releaseEphemeralShare(ctx, localSharePath)
+		return nil, err
+	}
+	ownershipContext := make(map[string]string, len(volumeContext)+1)
+	for key, value := range volumeContext {
+		ownershipContext[key] = value
+	}
+	ownershipContext[ownershipKey] = d.applyDirPermissions(localVolumePath, permissions)
+
+	ownershipOptions, err := ownershipMountOptions(ownershipContext, mountFlags)
+	if err != nil {
+		d.releaseEphemeralShare(ctx, localSharePath)
+		return nil, err
+	}
+
+	var readOnlyOptions []string
+	if request.GetReadonly() || isReaderOnly(request.GetVolumeCapability()) {
+		readOnlyOptions = []string{"ro"}
+	}
+	publishOptions, err := mounter.MergeMountFlags(ownershipOptions, mountFlags, readOnlyOptions)
+	if err != nil {
+		d.releaseEphemeralShare(ctx, localSharePath)
+		return nil, err
+	}
+
+	// Recorded before the volume is mounted, so the scratch directory is removed even if the node plugin restarts meanwhile
+	d.ephemeralVolumes.Add(volumeID, &ephemeralVolume{
+		Source:        serverSharePath,
+		SharePath:     localSharePath,
+		SealedSecrets: sealedSecrets,
+		MountFlags:    mountFlags,
+	})
+	d.recordMount(journal.Entry{Kind: journal.KindEphemeral, VolumeID: volumeID, Path: targetPath, Source: serverSharePath, StagingPath: localSharePath})
+
+	if err := d.Mounter.AuthMount(ctx, sourceMountPoint, targetPath, secrets, publishOptions); err != nil {
+		logging.FromContext(ctx, "node").Error(err, "Mounting ephemeral volume failed", "source", sourceMountPoint, "path", targetPath)
+		d.ephemeralVolumes.Remove(volumeID)
+		d.forgetMount(journal.KindEphemeral, targetPath)
+		if err := os.Remove(localVolumePath); err != nil && !os.IsNotExist(err) {
+			logging.FromContext(ctx, "node").Error(err, "Removing scratch directory of ephemeral volume failed", "path", localVolumePath)
+		}
+		d.releaseEphemeralShare(ctx, localSharePath)
+		return nil, err
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// unpublishEphemeralVolume unmounts an ephemeral volume and removes its scratch directory from the share
+func (d *Driver) unpublishEphemeralVolume(ctx context.Context, volumeID string, targetPath string, volume *ephemeralVolume) (*csi.NodeUnpublishVolumeResponse, error) {
+
+	// The content is only dropped through a mount of the scratch directory, never anything else at the target
+	sourceMountPoint := mounter.CifsSource(volume.Source, volumeID)
+	isMounted, err := d.isMountedFrom(targetPath, sourceMountPoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if isMounted {
+		entries, err := ioutil.ReadDir(targetPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed reading ephemeral volume %s: %s", volumeID, err.Error())
+		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(targetPath, entry.Name())); err != nil {
+				return nil, status.Errorf(codes.Internal, "Failed clearing ephemeral volume %s: %s", volumeID, err.Error())
+			}
+		}
+	}
+
+	if err := d.Mounter.Unmount(ctx, targetPath); err != nil {
+		return nil, err
+	}
+	if err := d.Mounter.RemoveMountPoint(targetPath); err != nil {
+		return nil, err
+	}
+
+	if err := d.removeScratchDir(ctx, volumeID, volume); err != nil {
+		return nil, err
+	}
+
+	d.ephemeralVolumes.Remove(volumeID)
+	d.forgetMount(journal.KindEphemeral, targetPath)
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// removeScratchDir removes the empty scratch directory through the share mount kept while the volume was published.
+// If the share mount is gone, the share is mounted again, which needs the secrets of a volume published since the last restart.
+func (d *Driver) removeScratchDir(ctx context.Context, volumeID string, volume *ephemeralVolume) error {
+
+	isShareMounted, err := d.isMountedFrom(volume.SharePath, volume.Source, nil)
+	if err != nil {
+		return err
+	}
+	if !isShareMounted {
+		if volume.SealedSecrets == nil {
+			logging.FromContext(ctx, "node").Info("Share of the ephemeral volume is not mounted anymore and its secrets are unknown, the scratch directory is left on the share",
+				"source", mounter.CifsSource(volume.Source, volumeID))
+			return d.Mounter.RemoveMountPoint(volume.SharePath)
+		}
+		secrets, err := d.secretBox.Open(volume.SealedSecrets)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Failed opening the secrets of ephemeral volume %s: %s", volumeID, err.Error())
+		}
+		if err := d.Mounter.AuthMount(ctx, volume.Source, volume.SharePath, secrets, volume.MountFlags); err != nil {
+			logging.FromContext(ctx, "node").Error(err, "Mounting share of ephemeral volume failed", "source", volume.Source)
+			return err
+		}
+	}
+
+	if err := os.Remove(filepath.Join(volume.SharePath, volumeID)); err != nil && !os.IsNotExist(err) {
+		logging.FromContext(ctx, "node").Error(err, "Removing scratch directory of ephemeral volume failed")
+	}
+	d.releaseEphemeralShare(ctx, volume.SharePath)
+	return nil
+}
+
+// releaseEphemeralShare unmounts the share of an ephemeral volume, failures only leave an empty mount point behind
+func (d *Driver) releaseEphemeralShare(ctx context.Context, localSharePath string) {
+	if err := d.Mounter.Unmount(ctx, localSharePath); err != nil {
+		logging.FromContext(ctx, "node").Error(err, "Unmounting share of ephemeral volume failed", "path", localSharePath)
+	} else if err := d.Mounter.RemoveMountPoint(localSharePath); err != nil {
+		logging.FromContext(ctx, "node").Error(err, "Removing mount point failed", "path", localSharePath)
+	}
+}
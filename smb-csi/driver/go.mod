@@ -3,11 +3,22 @@ module smb-csi/driver
 go 1.13
 
 require (
-	github.com/container-storage-interface/spec v1.4.0
+	github.com/container-storage-interface/spec v1.5.0
+	github.com/go-logr/logr v0.4.0
+	github.com/kubernetes-csi/csi-lib-utils v0.9.1
 	github.com/otiai10/copy v1.6.0
-	golang.org/x/sys v0.0.0-20210225134936-a50acf3fe073
-	google.golang.org/grpc v1.37.1
-	google.golang.org/protobuf v1.26.0
+	github.com/prometheus/client_golang v1.11.0
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.0.1 // indirect
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/sys v0.0.0-20210603081109-ebe580a85c40
+	google.golang.org/grpc v1.41.0
+	google.golang.org/protobuf v1.27.1
+	k8s.io/api v0.21.1
 	k8s.io/apimachinery v0.21.1
 	k8s.io/client-go v0.21.1
 	k8s.io/klog/v2 v2.8.0
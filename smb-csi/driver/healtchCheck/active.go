@@ -0,0 +1,102 @@
+package healtchCheck
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ActiveCheck writes, syncs, reads back and deletes the hidden file in the volume path,
+// finding volumes which are mounted but can't be used, e.g. because the share became read-only or the session expired.
+// A read-only volume is only listed. The probe is bounded by the timeout of the prober as well.
+func (p *Prober) ActiveCheck(volumePath string, fileName string, readOnly bool, slowThreshold time.Duration) (bool, string) {
+
+	started := time.Now()
+	var err error
+	if readOnly {
+		_, err = p.Run("list", volumePath, func() (interface{}, error) {
+			return nil, listDir(volumePath)
+		})
+	} else {
+		_, err = p.Run("readwrite", volumePath, func() (interface{}, error) {
+			return nil, readWriteFile(filepath.Join(volumePath, fileName))
+		})
+	}
+	if err != nil {
+		return false, activeCheckReason(err)
+	}
+
+	if latency := time.Since(started); slowThreshold > 0 && latency > slowThreshold {
+		return false, fmt.Sprintf("Volume is slow, the active probe took %s, more than %s", latency.Round(time.Millisecond), slowThreshold)
+	}
+	return true, ""
+}
+
+func listDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func readWriteFile(path string) error {
+	written := []byte(fmt.Sprintf("seitenbau.csi.smb health probe %d\n", time.Now().UnixNano()))
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(written); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	read, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, written) {
+		return errReadBackDiffers
+	}
+	return os.Remove(path)
+}
+
+var errReadBackDiffers = errors.New("read back data differs from the written data")
+
+// activeCheckReason turns the error of an active probe into the message of the volume condition
+func activeCheckReason(err error) string {
+	var timeout *ProbeTimeoutError
+	switch {
+	case errors.As(err, &timeout):
+		return err.Error()
+	case errors.Is(err, syscall.EROFS):
+		return fmt.Sprintf("Volume is read-only: %s", err.Error())
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return fmt.Sprintf("Permission denied on the volume: %s", err.Error())
+	case errors.Is(err, syscall.ESTALE):
+		return fmt.Sprintf("Stale file handle, the SMB session may have expired: %s", err.Error())
+	case errors.Is(err, syscall.EHOSTDOWN), errors.Is(err, syscall.ENOTCONN), errors.Is(err, syscall.ECONNABORTED):
+		return fmt.Sprintf("SMB server is not reachable: %s", err.Error())
+	case errors.Is(err, errReadBackDiffers):
+		return "Volume returned other data than was written to it"
+	}
+	return fmt.Sprintf("Active probe failed: %s", err.Error())
+}
@@ -6,9 +6,10 @@ import (
 	"os"
 )
 
-func HealthCheck(volumePath string, volumeCapacity int64) (bool, string) {
+// HealthCheck checks the volume path with probes bounded by the timeout of the prober
+func (p *Prober) HealthCheck(volumePath string, volumeCapacity int64) (bool, string) {
 
-	spExist, err := checkPathExist(volumePath)
+	spExist, err := p.checkPathExist(volumePath)
 	if err != nil {
 		return false, err.Error()
 	}
@@ -16,7 +17,7 @@ func HealthCheck(volumePath string, volumeCapacity int64) (bool, string) {
 		return false, "The source path of the volume doesn't exist"
 	}
 
-	capAndUsageValid, err := checkPVCapacityAndUsageValid(volumePath, volumeCapacity)
+	capAndUsageValid, err := p.checkPVCapacityAndUsageValid(volumePath, volumeCapacity)
 	if err != nil {
 		return false, err.Error()
 	}
@@ -28,12 +29,16 @@ func HealthCheck(volumePath string, volumeCapacity int64) (bool, string) {
 	return true, ""
 }
 
-func FsInfo(path string) (int64, int64, int64, int64, int64, int64, error) {
-	statfs := &unix.Statfs_t{}
-	err := unix.Statfs(path, statfs)
+// FsInfo returns the statfs info of the path, bounded by the timeout of the prober
+func (p *Prober) FsInfo(path string) (int64, int64, int64, int64, int64, int64, error) {
+	result, err := p.Run("statfs", path, func() (interface{}, error) {
+		statfs := &unix.Statfs_t{}
+		return statfs, unix.Statfs(path, statfs)
+	})
 	if err != nil {
 		return 0, 0, 0, 0, 0, 0, err
 	}
+	statfs := result.(*unix.Statfs_t)
 
 	// Available is blocks available * fragment size
 	available := int64(statfs.Bavail) * statfs.Bsize
@@ -51,8 +56,10 @@ func FsInfo(path string) (int64, int64, int64, int64, int64, int64, error) {
 	return available, capacity, usage, inodes, inodesFree, inodesUsed, nil
 }
 
-func checkPathExist(path string) (bool, error) {
-	_, err := os.Stat(path)
+func (p *Prober) checkPathExist(path string) (bool, error) {
+	_, err := p.Run("stat", path, func() (interface{}, error) {
+		return os.Stat(path)
+	})
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
@@ -63,9 +70,12 @@ func checkPathExist(path string) (bool, error) {
 
 	return true, nil
 }
-func checkPVCapacityAndUsageValid(volumePath string, volumeCapacity int64) (bool, error) {
+func (p *Prober) checkPVCapacityAndUsageValid(volumePath string, volumeCapacity int64) (bool, error) {
 
-	fsavailable, fscapacity, _, _, _, _, err := FsInfo(volumePath)
+	fsavailable, fscapacity, _, _, _, _, err := p.FsInfo(volumePath)
+	if _, isTimeout := err.(*ProbeTimeoutError); isTimeout {
+		return false, err
+	}
 	if err != nil {
 		return false, fmt.Errorf("failed to get capacity info: %+v", err)
 	}
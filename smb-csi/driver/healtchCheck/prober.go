@@ -0,0 +1,97 @@
+package healtchCheck
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Prober runs filesystem calls on volume paths in a bounded number of goroutines with a timeout.
+// On a hard cifs mount of an unreachable server, stat and statfs block in the kernel until the server is back.
+// Such a call is left behind in its goroutine, and later probes of the same path wait for it instead of starting another one.
+type Prober struct {
+	timeout time.Duration
+	slots   chan struct{}
+
+	mutex    sync.Mutex
+	inFlight map[string]*probe
+}
+
+type probe struct {
+	started time.Time
+	done    chan struct{}
+	result  interface{}
+	err     error
+}
+
+// ProbeTimeoutError is returned for a probe which did not finish within the timeout
+type ProbeTimeoutError struct {
+	Path  string
+	Since time.Time
+}
+
+func (e *ProbeTimeoutError) Error() string {
+	return fmt.Sprintf("%s does not respond since %s, the SMB server may be unreachable", e.Path, e.Since.Format(time.RFC3339))
+}
+
+func NewProber(timeout time.Duration, workers int) *Prober {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Prober{
+		timeout:  timeout,
+		slots:    make(chan struct{}, workers),
+		inFlight: make(map[string]*probe),
+	}
+}
+
+// Run calls the probe of the path, e.g. a stat of it, and waits for its result at most the timeout.
+// A probe of the same kind and path which is still running is waited for instead of calling the probe again.
+func (p *Prober) Run(kind string, path string, call func() (interface{}, error)) (interface{}, error) {
+	key := kind + ":" + path
+
+	p.mutex.Lock()
+	running, isRunning := p.inFlight[key]
+	if !isRunning {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			p.mutex.Unlock()
+			return nil, fmt.Errorf("all %d probe workers are blocked by unresponsive mounts", cap(p.slots))
+		}
+		running = &probe{started: time.Now(), done: make(chan struct{})}
+		p.inFlight[key] = running
+		go p.call(key, running, call)
+	}
+	p.mutex.Unlock()
+
+	// A probe which is hung already is not waited for again
+	wait := p.timeout - time.Since(running.started)
+	if wait <= 0 {
+		select {
+		case <-running.done:
+			return running.result, running.err
+		default:
+			return nil, &ProbeTimeoutError{Path: path, Since: running.started}
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-running.done:
+		return running.result, running.err
+	case <-timer.C:
+		return nil, &ProbeTimeoutError{Path: path, Since: running.started}
+	}
+}
+
+func (p *Prober) call(key string, running *probe, call func() (interface{}, error)) {
+	running.result, running.err = call()
+	close(running.done)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.inFlight, key)
+	<-p.slots
+}
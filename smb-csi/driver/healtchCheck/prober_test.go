@@ -0,0 +1,78 @@
+package healtchCheck
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProber_HungProbeTimesOutAndIsCoalesced(t *testing.T) {
+	prober := NewProber(50*time.Millisecond, 1)
+	hung := make(chan struct{})
+	defer close(hung)
+	var calls int32
+	probe := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-hung
+		return nil, nil
+	}
+
+	_, err := prober.Run("stat", "/hung", probe)
+	assert.IsType(t, &ProbeTimeoutError{}, err)
+
+	// The probe still hangs, so it is not called again
+	_, err = prober.Run("stat", "/hung", probe)
+	assert.IsType(t, &ProbeTimeoutError{}, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// The only worker is blocked by the hung probe
+	_, err = prober.Run("stat", "/other", probe)
+	assert.Error(t, err)
+}
+
+func TestProber_HealthCheckOfMissingPath(t *testing.T) {
+	prober := NewProber(time.Second, 1)
+	healthy, reason := prober.HealthCheck("/does/not/exist", 0)
+	assert.False(t, healthy)
+	assert.NotEmpty(t, reason)
+}
+
+func TestProber_ActiveCheck(t *testing.T) {
+	volumePath, err := ioutil.TempDir("", "active")
+	assert.NoError(t, err)
+	defer os.RemoveAll(volumePath)
+	prober := NewProber(time.Second, 1)
+
+	healthy, reason := prober.ActiveCheck(volumePath, ".csi-health-probe-test", false, time.Minute)
+	assert.True(t, healthy)
+	assert.Empty(t, reason)
+	// The probe file is removed again
+	_, err = os.Stat(filepath.Join(volumePath, ".csi-health-probe-test"))
+	assert.True(t, os.IsNotExist(err))
+
+	healthy, reason = prober.ActiveCheck(volumePath, ".csi-health-probe-test", true, time.Minute)
+	assert.True(t, healthy)
+	assert.Empty(t, reason)
+}
+
+func TestProber_ActiveCheckSlow(t *testing.T) {
+	volumePath, err := ioutil.TempDir("", "active")
+	assert.NoError(t, err)
+	defer os.RemoveAll(volumePath)
+	prober := NewProber(time.Second, 1)
+
+	healthy, reason := prober.ActiveCheck(volumePath, ".csi-health-probe-test", false, time.Nanosecond)
+	assert.False(t, healthy)
+	assert.Contains(t, reason, "slow")
+}
+
+func TestProber_ActiveCheckMissingVolume(t *testing.T) {
+	prober := NewProber(time.Second, 1)
+	healthy, reason := prober.ActiveCheck("/does/not/exist", ".csi-health-probe-test", false, time.Minute)
+	assert.False(t, healthy)
+	assert.NotEmpty(t, reason)
+}
@@ -0,0 +1,153 @@
+package journal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// A stage mount of the share at the staging path
+	KindStage = "stage"
+	// A bind mount of a stage mount at the target path of a pod
+	KindPublish = "publish"
+	// A mount of the scratch directory of an ephemeral volume at the target path of a pod
+	KindEphemeral = "ephemeral"
+)
+
+// Entry is a mount the node plugin made and has not removed yet
+type Entry struct {
+	Kind     string `json:"kind"`
+	VolumeID string `json:"volumeID"`
+	// Mount point of the stage or publish mount
+	Path string `json:"path"`
+	// Cifs source of a stage mount, the share of an ephemeral volume
+	Source string `json:"source,omitempty"`
+	// Stage mount a publish mount is bound from, the share mount of an ephemeral volume
+	StagingPath string `json:"stagingPath,omitempty"`
+	ReadOnly    bool   `json:"readOnly,omitempty"`
+	// Volume mount group of the mount
+	Group     string    `json:"group,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Journal records the stage and publish mounts of the node plugin in a file, so they are known after a restart.
+// The file is replaced atomically on every change, a crash leaves either the old or the new journal.
+type Journal struct {
+	path string
+
+	mutex   sync.Mutex
+	entries map[string]Entry
+}
+
+// Open loads the journal file, which does not have to exist yet
+func Open(path string) (*Journal, error) {
+	journal := &Journal{path: path, entries: make(map[string]Entry)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return journal, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		journal.entries[key(entry.Kind, entry.Path)] = entry
+	}
+	return journal, nil
+}
+
+func key(kind string, path string) string {
+	return kind + ":" + filepath.Clean(path)
+}
+
+// Record adds or replaces the entry of the mount
+func (j *Journal) Record(entry Entry) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entry.Path = filepath.Clean(entry.Path)
+	if entry.StagingPath != "" {
+		entry.StagingPath = filepath.Clean(entry.StagingPath)
+	}
+	entry.UpdatedAt = time.Now()
+	j.entries[key(entry.Kind, entry.Path)] = entry
+	return j.save()
+}
+
+// Remove drops the entry of the mount, if there is one
+func (j *Journal) Remove(kind string, path string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if _, isRecorded := j.entries[key(kind, path)]; !isRecorded {
+		return nil
+	}
+	delete(j.entries, key(kind, path))
+	return j.save()
+}
+
+// Get returns the entry of the mount, if there is one
+func (j *Journal) Get(kind string, path string) (Entry, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entry, isRecorded := j.entries[key(kind, path)]
+	return entry, isRecorded
+}
+
+// Entries returns the recorded mounts, stage mounts before the publish mounts bound from them
+func (j *Journal) Entries() []Entry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entries := make([]Entry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		if entries[a].Kind != entries[b].Kind {
+			return entries[a].Kind == KindStage
+		}
+		return entries[a].Path < entries[b].Path
+	})
+	return entries
+}
+
+func (j *Journal) save() error {
+	entries := make([]Entry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool { return key(entries[a].Kind, entries[a].Path) < key(entries[b].Kind, entries[b].Path) })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0750); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), j.path)
+}
@@ -0,0 +1,48 @@
+package journal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal_SurvivesReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	journalPath := filepath.Join(dir, "node-journal.json")
+
+	nodeJournal, err := Open(journalPath)
+	assert.NoError(t, err)
+	assert.Empty(t, nodeJournal.Entries())
+
+	assert.NoError(t, nodeJournal.Record(Entry{Kind: KindPublish, VolumeID: "testID", Path: "/tmp/target/", StagingPath: "/tmp/staging", ReadOnly: true}))
+	assert.NoError(t, nodeJournal.Record(Entry{Kind: KindStage, VolumeID: "testID", Path: "/tmp/staging", Source: "//server/share/testID"}))
+	assert.NoError(t, nodeJournal.Record(Entry{Kind: KindPublish, VolumeID: "testID", Path: "/tmp/other-target", StagingPath: "/tmp/staging"}))
+	assert.NoError(t, nodeJournal.Remove(KindPublish, "/tmp/other-target"))
+
+	reopened, err := Open(journalPath)
+	assert.NoError(t, err)
+	entries := reopened.Entries()
+	assert.Len(t, entries, 2)
+	// Stage mounts come before the publish mounts bound from them
+	assert.Equal(t, KindStage, entries[0].Kind)
+	assert.Equal(t, "//server/share/testID", entries[0].Source)
+	assert.Equal(t, KindPublish, entries[1].Kind)
+	assert.Equal(t, "/tmp/target", entries[1].Path)
+	assert.True(t, entries[1].ReadOnly)
+}
+
+func TestJournal_CorruptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	journalPath := filepath.Join(dir, "node-journal.json")
+	assert.NoError(t, ioutil.WriteFile(journalPath, []byte("{"), 0600))
+
+	nodeJournal, err := Open(journalPath)
+	assert.Error(t, err)
+	assert.Nil(t, nodeJournal)
+}
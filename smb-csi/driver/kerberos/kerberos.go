@@ -0,0 +1,242 @@
+package kerberos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"k8s.io/klog/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keys of the node stage secret for Kerberos authentication
+const (
+	principalKey = "principal"
+	keytabKey    = "keytab"
+	passwordKey  = "password"
+)
+
+// Credentials to obtain tickets with, either from a keytab or with a password
+type Credentials struct {
+	Principal string
+	Keytab    []byte
+	Password  string
+}
+
+// FromSecrets returns the Kerberos credentials of the secrets.
+// Secrets without a principal are no Kerberos secrets, in this case false is returned.
+func FromSecrets(secrets map[string]string) (*Credentials, bool, error) {
+	principal, isPrincipalPresent := secrets[principalKey]
+	if !isPrincipalPresent {
+		return nil, false, nil
+	}
+	principal = strings.TrimSpace(principal)
+	if principal == "" {
+		return nil, true, fmt.Errorf("secret %s is empty", principalKey)
+	}
+
+	credentials := &Credentials{Principal: principal}
+	if keytab, isKeytabPresent := secrets[keytabKey]; isKeytabPresent && keytab != "" {
+		credentials.Keytab = []byte(keytab)
+	} else if password, isPasswordPresent := secrets[passwordKey]; isPasswordPresent && password != "" {
+		credentials.Password = password
+	} else {
+		return nil, true, fmt.Errorf("secret needs a %s or a %s for principal %s", keytabKey, passwordKey, principal)
+	}
+	return credentials, true, nil
+}
+
+// Manager obtains tickets into one credential cache per volume and renews them,
+// as long as the volume is logged in.
+type Manager struct {
+	cacheDir      string
+	renewInterval time.Duration
+
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	dir         string
+	cache       string
+	credentials Credentials
+	stop        chan struct{}
+}
+
+func NewManager(cacheDir string, renewInterval time.Duration) *Manager {
+	return &Manager{
+		cacheDir:      cacheDir,
+		renewInterval: renewInterval,
+		sessions:      make(map[string]*session),
+	}
+}
+
+// Login obtains tickets for the volume and returns the credential cache holding them.
+// The tickets are renewed in the background until Logout is called.
+// Logging in a volume again replaces its credentials.
+func (m *Manager) Login(volumeID string, credentials Credentials) (string, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// The kernel upcall reads the cache on the host, so it must be on a path shared with the host
+	dir := m.sessionDir(volumeID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed creating credential cache directory: %s", err)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed securing credential cache directory: %s", err)
+	}
+
+	newSession := &session{
+		dir:         dir,
+		cache:       "FILE:" + filepath.Join(dir, "ccache"),
+		credentials: credentials,
+		stop:        make(chan struct{}),
+	}
+	if err := newSession.kinit(); err != nil {
+		return "", err
+	}
+
+	if existing, isSessionPresent := m.sessions[volumeID]; isSessionPresent {
+		close(existing.stop)
+	}
+	m.sessions[volumeID] = newSession
+	go m.renew(volumeID, newSession)
+
+	return newSession.cache, nil
+}
+
+// Resume renews the tickets of a volume logged in before a restart, if its credential cache is still there.
+// The credentials are not known anymore, so the tickets are only renewed as long as they are renewable.
+func (m *Manager) Resume(volumeID string) bool {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, isSessionPresent := m.sessions[volumeID]; isSessionPresent {
+		return true
+	}
+	dir := m.sessionDir(volumeID)
+	if _, err := os.Stat(filepath.Join(dir, "ccache")); err != nil {
+		return false
+	}
+
+	resumed := &session{
+		dir:   dir,
+		cache: "FILE:" + filepath.Join(dir, "ccache"),
+		stop:  make(chan struct{}),
+	}
+	m.sessions[volumeID] = resumed
+	// The tickets may be close to their end after the driver was down
+	go func() {
+		if resumed.renew(volumeID) {
+			m.renew(volumeID, resumed)
+		}
+	}()
+	return true
+}
+
+func (m *Manager) sessionDir(volumeID string) string {
+	return filepath.Join(m.cacheDir, strings.Replace(volumeID, "/", "_", -1))
+}
+
+// Logout stops renewing the tickets of the volume and destroys its credential cache
+func (m *Manager) Logout(volumeID string) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	existing, isSessionPresent := m.sessions[volumeID]
+	if !isSessionPresent {
+		return
+	}
+	close(existing.stop)
+	delete(m.sessions, volumeID)
+
+	if output, err := exec.Command("kdestroy", "-c", existing.cache).CombinedOutput(); err != nil {
+		klog.Infof("Failed destroying credential cache of volume %s: %s: %s", volumeID, err.Error(), strings.TrimSpace(string(output)))
+	}
+	if err := os.RemoveAll(existing.dir); err != nil {
+		klog.Infof("Failed removing credential cache directory %s: %s", existing.dir, err.Error())
+	}
+}
+
+// Stop ends all renewals, the credential caches are left for the mounts still using them
+func (m *Manager) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for volumeID, existing := range m.sessions {
+		close(existing.stop)
+		delete(m.sessions, volumeID)
+	}
+}
+
+func (m *Manager) renew(volumeID string, s *session) {
+	ticker := time.NewTicker(m.renewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if !s.renew(volumeID) {
+				return
+			}
+		}
+	}
+}
+
+// renew renews the tickets of the session and returns false if they can't be renewed anymore
+func (s *session) renew(volumeID string) bool {
+	// A ticket past its renewable lifetime can't be renewed, a new one is obtained instead
+	output, err := exec.Command("kinit", "-R", "-c", s.cache).CombinedOutput()
+	if err == nil {
+		return true
+	}
+	klog.Infof("Failed renewing tickets of volume %s: %s: %s", volumeID, err.Error(), strings.TrimSpace(string(output)))
+	if s.credentials.Principal == "" {
+		klog.Infof("Credentials of volume %s are not known since a restart, it has to be staged again to obtain new tickets", volumeID)
+		return false
+	}
+	if err := s.kinit(); err != nil {
+		klog.Infof("Failed obtaining tickets of volume %s: %s", volumeID, err.Error())
+	}
+	return true
+}
+
+// kinit obtains new tickets for the principal into the credential cache of the session
+func (s *session) kinit() error {
+
+	args := []string{"-c", s.cache}
+	var stdin string
+
+	if len(s.credentials.Keytab) > 0 {
+		keytab, err := ioutil.TempFile(s.dir, "keytab-")
+		if err != nil {
+			return fmt.Errorf("failed creating keytab: %s", err)
+		}
+		defer os.Remove(keytab.Name())
+		_, writeErr := keytab.Write(s.credentials.Keytab)
+		keytab.Close()
+		if writeErr != nil {
+			return fmt.Errorf("failed writing keytab: %s", writeErr)
+		}
+		args = append(args, "-k", "-t", keytab.Name())
+	} else {
+		// The password is read from stdin, so it is not visible in the process list
+		stdin = s.credentials.Password + "\n"
+	}
+	args = append(args, s.credentials.Principal)
+
+	cmd := exec.Command("kinit", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("kinit for %s failed: %s: %s", s.credentials.Principal, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
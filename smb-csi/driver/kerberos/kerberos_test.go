@@ -0,0 +1,28 @@
+package kerberos
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManager_ResumesSessionOfCredentialCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "krb5")
+	assert.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "testID"), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(cacheDir, "testID", "ccache"), []byte("tickets"), 0600))
+
+	manager := NewManager(cacheDir, time.Hour)
+	defer manager.Stop()
+	assert.True(t, manager.Resume("testID"))
+	assert.False(t, manager.Resume("otherID"))
+
+	// Unstaging the volume destroys the resumed credential cache
+	manager.Logout("testID")
+	_, err = os.Stat(filepath.Join(cacheDir, "testID"))
+	assert.True(t, os.IsNotExist(err))
+}
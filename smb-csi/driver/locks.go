@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"smb-csi/driver/metrics"
+	"sync"
+)
+
+// operationLocks keeps track of the volumes or snapshots with an operation in progress.
+// The CSI spec requires a plugin to answer a conflicting operation with codes.Aborted.
+type operationLocks struct {
+	kind       string
+	mutex      sync.Mutex
+	operations map[string]string
+}
+
+func newOperationLocks(kind string) *operationLocks {
+	return &operationLocks{
+		kind:       kind,
+		operations: make(map[string]string),
+	}
+}
+
+// Acquire locks the id for the operation or returns an Aborted error if another operation holds it
+func (l *operationLocks) Acquire(id string, operation string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if inFlight, isLocked := l.operations[id]; isLocked {
+		metrics.AbortedOperations.WithLabelValues(operation).Inc()
+		return status.Errorf(codes.Aborted, "An operation (%s) on %s %s is already in progress", inFlight, l.kind, id)
+	}
+	l.operations[id] = operation
+	metrics.InFlightOperations.WithLabelValues(operation).Inc()
+	return nil
+}
+
+func (l *operationLocks) Release(id string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if operation, isLocked := l.operations[id]; isLocked {
+		metrics.InFlightOperations.WithLabelValues(operation).Dec()
+		delete(l.operations, id)
+	}
+}
@@ -0,0 +1,21 @@
+package driver
+
+import (
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestOperationLocks_ConflictingOperationIsAborted(t *testing.T) {
+	locks := newOperationLocks("volume")
+	assert.NoError(t, locks.Acquire("testID", "NodeStageVolume"))
+
+	err := locks.Acquire("testID", "NodePublishVolume")
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	// Other volumes are not locked
+	assert.NoError(t, locks.Acquire("testID2", "NodeStageVolume"))
+
+	locks.Release("testID")
+	assert.NoError(t, locks.Acquire("testID", "NodePublishVolume"))
+}
@@ -0,0 +1,46 @@
+package driver
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"path"
+	"smb-csi/driver/logging"
+)
+
+// requestLogFields returns the fields every log line of the request carries.
+// The volume and snapshot a request is about are named differently depending on the request.
+func (d *Driver) requestLogFields(correlationID string, fullMethod string, request interface{}) []interface{} {
+	fields := []interface{}{logging.CorrelationIDKey, correlationID, logging.MethodKey, path.Base(fullMethod)}
+
+	var volumeID, snapshotID, nodeID string
+	switch r := request.(type) {
+	case *csi.CreateVolumeRequest:
+		volumeID = r.GetName()
+	case *csi.CreateSnapshotRequest:
+		volumeID, snapshotID = r.GetSourceVolumeId(), r.GetName()
+	default:
+		if withVolume, isWithVolume := request.(interface{ GetVolumeId() string }); isWithVolume {
+			volumeID = withVolume.GetVolumeId()
+		}
+		if withSnapshot, isWithSnapshot := request.(interface{ GetSnapshotId() string }); isWithSnapshot {
+			snapshotID = withSnapshot.GetSnapshotId()
+		}
+		if withSource, isWithSource := request.(interface{ GetSourceVolumeId() string }); isWithSource && volumeID == "" {
+			volumeID = withSource.GetSourceVolumeId()
+		}
+	}
+	// The controller is told which node a volume is published on, the node plugin is the node
+	if withNode, isWithNode := request.(interface{ GetNodeId() string }); isWithNode {
+		nodeID = withNode.GetNodeId()
+	}
+	if nodeID == "" {
+		nodeID = d.NodeID
+	}
+
+	if volumeID != "" {
+		fields = append(fields, logging.VolumeIDKey, volumeID)
+	}
+	if snapshotID != "" {
+		fields = append(fields, logging.SnapshotIDKey, snapshotID)
+	}
+	return append(fields, logging.NodeIDKey, nodeID)
+}
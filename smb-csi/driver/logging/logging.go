@@ -0,0 +1,273 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	"io"
+	"k8s.io/klog/v2"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields of the request a log line belongs to
+const (
+	CorrelationIDKey = "correlation_id"
+	MethodKey        = "method"
+	VolumeIDKey      = "volume_id"
+	SnapshotIDKey    = "snapshot_id"
+	NodeIDKey        = "node_id"
+)
+
+const (
+	// Lines in the klog format, the fields of the request follow the message as key="value"
+	FormatText = "text"
+	// One JSON object per line, klog lines of other packages are wrapped into the msg
+	FormatJSON = "json"
+)
+
+// Subsystems whose verbosity can be set on their own
+var Subsystems = []string{"grpc", "controller", "node", "mounter", "snapshotter", "sharemount", "remount", "journal"}
+
+var settings = struct {
+	mutex     sync.RWMutex
+	json      bool
+	out       io.Writer
+	verbosity map[string]int
+}{out: os.Stderr, verbosity: make(map[string]int)}
+
+// Setup selects the format of the log lines and the verbosity of subsystems, like mounter=5,snapshotter=2.
+// Subsystems without a verbosity of their own log at the verbosity of -v.
+func Setup(format string, verbosity string) error {
+	levels, err := parseVerbosity(verbosity)
+	if err != nil {
+		return err
+	}
+
+	settings.mutex.Lock()
+	defer settings.mutex.Unlock()
+	switch format {
+	case FormatText, "":
+		settings.json = false
+		// The text lines are written by klog itself
+		klog.SetLogger(nil)
+	case FormatJSON:
+		settings.json = true
+		// The lines of klog, e.g. of client-go, end up in the same stream
+		klog.SetLogger(&logger{subsystem: "klog"})
+	default:
+		return fmt.Errorf("unknown log format %q, supported are %s and %s", format, FormatText, FormatJSON)
+	}
+	settings.verbosity = levels
+	return nil
+}
+
+// SetOutput redirects the JSON lines, which go to stderr by default
+func SetOutput(out io.Writer) {
+	settings.mutex.Lock()
+	defer settings.mutex.Unlock()
+	settings.out = out
+}
+
+func parseVerbosity(verbosity string) (map[string]int, error) {
+	levels := make(map[string]int)
+	if verbosity == "" {
+		return levels, nil
+	}
+	for _, setting := range strings.Split(verbosity, ",") {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid log verbosity %q, expected subsystem=level", setting)
+		}
+		subsystem := strings.TrimSpace(parts[0])
+		if !isSubsystem(subsystem) {
+			return nil, fmt.Errorf("unknown subsystem %q in log verbosity, supported are %s", subsystem, strings.Join(Subsystems, ", "))
+		}
+		level, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || level < 0 {
+			return nil, fmt.Errorf("invalid log verbosity %q of subsystem %s", parts[1], subsystem)
+		}
+		levels[subsystem] = level
+	}
+	return levels, nil
+}
+
+func isSubsystem(name string) bool {
+	for _, subsystem := range Subsystems {
+		if subsystem == name {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// WithFields returns a context whose loggers add the fields, given as key value pairs, to every line
+func WithFields(ctx context.Context, keysAndValues ...interface{}) context.Context {
+	fields, _ := ctx.Value(contextKey{}).([]interface{})
+	merged := make([]interface{}, 0, len(fields)+len(keysAndValues))
+	merged = append(append(merged, fields...), keysAndValues...)
+	return context.WithValue(ctx, contextKey{}, merged)
+}
+
+// FromContext returns the logger of the subsystem with the fields of the request in the context
+func FromContext(ctx context.Context, subsystem string) logr.Logger {
+	fields, _ := ctx.Value(contextKey{}).([]interface{})
+	return &logger{subsystem: subsystem, values: fields}
+}
+
+// For returns the logger of the subsystem for work which does not belong to a request
+func For(subsystem string) logr.Logger {
+	return &logger{subsystem: subsystem}
+}
+
+// NewCorrelationID returns a random ID which ties the log lines of a request together
+func NewCorrelationID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// logger is a logr.Logger writing klog or JSON lines, which are filtered by the verbosity of its subsystem
+type logger struct {
+	subsystem string
+	level     int
+	values    []interface{}
+}
+
+func (l *logger) Enabled() bool {
+	settings.mutex.RLock()
+	verbosity, isSet := settings.verbosity[l.subsystem]
+	settings.mutex.RUnlock()
+	if isSet {
+		return l.level <= verbosity
+	}
+	return klog.V(klog.Level(l.level)).Enabled()
+}
+
+func (l *logger) Info(msg string, keysAndValues ...interface{}) {
+	if l.Enabled() {
+		l.write(nil, false, msg, keysAndValues)
+	}
+}
+
+func (l *logger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.write(err, true, msg, keysAndValues)
+}
+
+func (l *logger) V(level int) logr.Logger {
+	return &logger{subsystem: l.subsystem, level: l.level + level, values: l.values}
+}
+
+func (l *logger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	values := make([]interface{}, 0, len(l.values)+len(keysAndValues))
+	values = append(append(values, l.values...), keysAndValues...)
+	return &logger{subsystem: l.subsystem, level: l.level, values: values}
+}
+
+func (l *logger) WithName(name string) logr.Logger {
+	return &logger{subsystem: name, level: l.level, values: l.values}
+}
+
+func (l *logger) write(err error, isError bool, msg string, keysAndValues []interface{}) {
+	fields := make([]interface{}, 0, 2+len(l.values)+len(keysAndValues))
+	fields = append(fields, "subsystem", l.subsystem)
+	fields = append(append(fields, l.values...), keysAndValues...)
+
+	settings.mutex.RLock()
+	isJSON, out := settings.json, settings.out
+	settings.mutex.RUnlock()
+
+	if !isJSON {
+		// Depth of the caller of Info or Error
+		if isError {
+			klog.ErrorSDepth(2, err, msg, fields...)
+		} else {
+			klog.InfoSDepth(2, msg, fields...)
+		}
+		return
+	}
+
+	line := map[string]interface{}{
+		"ts":  time.Now().UTC().Format(time.RFC3339Nano),
+		"msg": strings.TrimSpace(msg),
+	}
+	if isError {
+		line["level"] = "error"
+	} else {
+		line["level"] = "info"
+		line["v"] = l.level
+	}
+	if err != nil {
+		line["err"] = err.Error()
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if i+1 >= len(fields) {
+			line[key] = nil
+			break
+		}
+		line[key] = jsonValue(fields[i+1])
+	}
+	out.Write(encodeLine(line))
+}
+
+// encodeLine writes the line with the ts, level and msg first, which makes it easier to read for humans
+func encodeLine(line map[string]interface{}) []byte {
+	keys := make([]string, 0, len(line))
+	for key := range line {
+		keys = append(keys, key)
+	}
+	first := map[string]int{"ts": 0, "level": 1, "v": 2, "msg": 3}
+	sort.Slice(keys, func(a, b int) bool {
+		rankA, isFirstA := first[keys[a]]
+		rankB, isFirstB := first[keys[b]]
+		if isFirstA || isFirstB {
+			if isFirstA && isFirstB {
+				return rankA < rankB
+			}
+			return isFirstA
+		}
+		return keys[a] < keys[b]
+	})
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		encodedKey, _ := json.Marshal(key)
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		encodedValue, err := json.Marshal(line[key])
+		if err != nil {
+			encodedValue, _ = json.Marshal(fmt.Sprint(line[key]))
+		}
+		buf.Write(encodedValue)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetup_JSONLinesCarryRequestFields(t *testing.T) {
+	var out bytes.Buffer
+	SetOutput(&out)
+	assert.NoError(t, Setup(FormatJSON, "mounter=4"))
+	defer func() {
+		assert.NoError(t, Setup(FormatText, ""))
+		SetOutput(os.Stderr)
+	}()
+
+	ctx := WithFields(context.Background(), CorrelationIDKey, "c0ffee", MethodKey, "NodeStageVolume", VolumeIDKey, "testID")
+	FromContext(ctx, "mounter").V(4).Info("Mounting share", "source", "//server/share")
+	// Subsystems without a verbosity of their own log at the verbosity of -v
+	FromContext(ctx, "snapshotter").V(4).Info("Creating snapshot")
+	FromContext(ctx, "node").Error(errors.New("mount error(13): Permission denied"), "Mounting stage mount failed")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	var mountLine, errorLine map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &mountLine))
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &errorLine))
+	assert.Equal(t, "Mounting share", mountLine["msg"])
+	assert.Equal(t, "mounter", mountLine["subsystem"])
+	assert.Equal(t, "c0ffee", mountLine["correlation_id"])
+	assert.Equal(t, "testID", mountLine["volume_id"])
+	assert.Equal(t, "//server/share", mountLine["source"])
+	assert.Equal(t, "error", errorLine["level"])
+	assert.Equal(t, "NodeStageVolume", errorLine["method"])
+	assert.Equal(t, "mount error(13): Permission denied", errorLine["err"])
+}
+
+func TestSetup_InvalidVerbosity(t *testing.T) {
+	assert.Error(t, Setup(FormatText, "mountr=4"))
+	assert.Error(t, Setup(FormatText, "mounter"))
+	assert.Error(t, Setup("yaml", ""))
+}
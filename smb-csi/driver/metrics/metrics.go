@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+const namespace = "smb_csi"
+
+// Durations of mounts and snapshots on a share range from milliseconds to many minutes
+var durationBuckets = prometheus.ExponentialBuckets(0.005, 2.5, 14)
+
+var (
+	// InFlightOperations counts the CSI operations currently holding a volume or snapshot lock
+	InFlightOperations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "inflight_operations",
+		Help:      "Number of CSI operations currently in progress, by operation.",
+	}, []string{"operation"})
+
+	// AbortedOperations counts the CSI operations rejected because of a conflicting operation in progress
+	AbortedOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "aborted_operations_total",
+		Help:      "Number of CSI operations aborted because another operation on the same volume or snapshot was in progress.",
+	}, []string{"operation"})
+
+	// RPCRequests counts the CSI requests by method and gRPC status code
+	RPCRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_requests_total",
+		Help:      "Number of CSI requests, by method and gRPC status code.",
+	}, []string{"method", "code"})
+
+	// RPCDuration measures the CSI requests by method
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of CSI requests, by method.",
+		Buckets:   durationBuckets,
+	}, []string{"method"})
+
+	// MountDuration measures mounts and unmounts of shares by SMB server
+	MountDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mount_duration_seconds",
+		Help:      "Duration of cifs mounts and unmounts, by operation, SMB server and result.",
+		Buckets:   durationBuckets,
+	}, []string{"operation", "server", "result"})
+
+	// SnapshotDuration measures creating snapshots, restoring them and cloning volumes
+	SnapshotDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "snapshot_duration_seconds",
+		Help:      "Duration of creating snapshots, restoring them and cloning volumes, by operation and result.",
+		Buckets:   durationBuckets,
+	}, []string{"operation", "result"})
+
+	// SnapshotBytes counts the bytes written by snapshots, restores and clones
+	SnapshotBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "snapshot_bytes_total",
+		Help:      "Bytes of the snapshot files created, the snapshot files restored and the volumes cloned, by operation.",
+	}, []string{"operation"})
+
+	// StageMounts is the number of stage mounts of the node plugin, including those of other volume mount groups
+	StageMounts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stage_mounts",
+		Help:      "Number of active stage mounts of the node plugin.",
+	})
+)
+
+var collectors = []prometheus.Collector{
+	InFlightOperations, AbortedOperations, RPCRequests, RPCDuration, MountDuration, SnapshotDuration, SnapshotBytes, StageMounts,
+}
+
+// Result returns the result label of an operation
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// ObserveMount records the duration of a mount or unmount of a share of the server
+func ObserveMount(operation string, server string, started time.Time, err error) {
+	MountDuration.WithLabelValues(operation, server, Result(err)).Observe(time.Since(started).Seconds())
+}
+
+// ObserveSnapshot records the duration of a snapshot, restore or clone and the bytes it wrote
+func ObserveSnapshot(operation string, started time.Time, bytes int64, err error) {
+	SnapshotDuration.WithLabelValues(operation, Result(err)).Observe(time.Since(started).Seconds())
+	if err == nil && bytes > 0 {
+		SnapshotBytes.WithLabelValues(operation).Add(float64(bytes))
+	}
+}
+
+// Serve serves the metrics at /metrics of the address in the background.
+// All metrics are labelled with the mode of the driver, so the controller and the node plugins can be told apart.
+func Serve(address string, mode string) error {
+	registry := prometheus.NewRegistry()
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{"mode": mode}, registry)
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+	if err := registry.Register(prometheus.NewGoCollector()); err != nil {
+		return err
+	}
+	if err := registry.Register(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{})); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		klog.Infof("Serving metrics at %s/metrics", listener.Addr())
+		if err := http.Serve(listener, mux); err != nil {
+			klog.Errorf("Failed serving metrics: %s", err.Error())
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,16 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestObserveSnapshot_BytesOnlyOnSuccess(t *testing.T) {
+	before := testutil.ToFloat64(SnapshotBytes.WithLabelValues("clone"))
+	ObserveSnapshot("clone", time.Now(), 1024, nil)
+	ObserveSnapshot("clone", time.Now(), 2048, errors.New("copy failed"))
+	assert.Equal(t, before+1024, testutil.ToFloat64(SnapshotBytes.WithLabelValues("clone")))
+}
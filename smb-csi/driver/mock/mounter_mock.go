@@ -1,16 +1,22 @@
 package mock
 
 import (
+	"context"
 	"golang.org/x/sys/unix"
 	"os"
 	"smb-csi/driver/mounter"
 )
 
-type FakeMounter struct {}
+type FakeMounter struct {
+	// Target paths of the bind mounts and if they are read-only
+	BindMounts map[string]bool
+	// Sources of the share mounts, in the order they were mounted
+	Sources []string
+}
 
 func NewFakeMounter() *mounter.Mounter {
 	var fakeMounter mounter.Mounter
-	fakeMounter = &FakeMounter{}
+	fakeMounter = &FakeMounter{BindMounts: make(map[string]bool)}
 	return &fakeMounter
 }
 
@@ -30,22 +36,57 @@ func (*FakeMounter) CreateDir(path string, mode os.FileMode) error {
 	return nil
 }
 
-func (*FakeMounter) DeleteDir(path string) error {
+func (*FakeMounter) SetPermissions(path string, mode os.FileMode, uid int, gid int) error {
+	return nil
+}
+
+func (*FakeMounter) GetPermissions(path string) (os.FileMode, int, int, error) {
+	return 0755, 0, 0, nil
+}
+
+func (*FakeMounter) RemoveMountPoint(path string) error {
+	return nil
+}
+
+func (*FakeMounter) Mount(ctx context.Context, src string, target string, mountOptions []string) error {
+	return nil
+}
+
+func (f *FakeMounter) BindMount(ctx context.Context, src string, target string, readOnly bool) error {
+	f.BindMounts[target] = readOnly
 	return nil
 }
 
-func (*FakeMounter) Mount(src string, target string, mountOptions []string) error {
+func (*FakeMounter) Unmount(ctx context.Context, target string) error {
 	return nil
 }
 
-func (*FakeMounter) BindMount(src string, target string) error {
+func (*FakeMounter) DetachMount(ctx context.Context, target string) error {
 	return nil
 }
 
-func (*FakeMounter) Unmount(target string) error {
+func (*FakeMounter) IsMountPoint(path string) (bool, error) {
+	return false, nil
+}
+
+func (*FakeMounter) GetMount(path string) (*mounter.MountInfo, error) {
+	return nil, nil
+}
+
+func (*FakeMounter) GetBindMounts(path string) ([]mounter.MountInfo, error) {
+	return nil, nil
+}
+
+func (*FakeMounter) GetSessionSecurity(source string) (*mounter.SessionSecurity, error) {
+	return &mounter.SessionSecurity{Signed: true, Encrypted: true}, nil
+}
+
+func (f *FakeMounter) AuthMount(ctx context.Context, source string, targetPath string, secrets map[string]string, mountFlags []string) error {
+	f.Sources = append(f.Sources, source)
 	return nil
 }
 
-func (*FakeMounter) AuthMount(source string, targetPath string, secrets map[string]string, mountFlags []string) error {
+func (f *FakeMounter) KerberosMount(ctx context.Context, source string, targetPath string, credentialCache string, mountFlags []string) error {
+	f.Sources = append(f.Sources, source)
 	return nil
 }
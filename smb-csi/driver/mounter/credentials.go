@@ -0,0 +1,53 @@
+package mounter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Directory of the short lived credentials files, only accessible by root
+var credentialsDir = filepath.Join(os.TempDir(), "smb-csi-credentials")
+
+// writeCredentialsFile writes the secrets in the format of the mount.cifs credentials option.
+// This keeps them out of the mount command line and thus out of ps and the logs.
+// The file must be removed by the caller once the mount returned.
+func writeCredentialsFile(secrets map[string]string) (string, error) {
+
+	if err := os.MkdirAll(credentialsDir, 0700); err != nil {
+		return "", fmt.Errorf("failed creating credentials directory: %s", err)
+	}
+	// MkdirAll does not change the mode of an existing directory
+	if err := os.Chmod(credentialsDir, 0700); err != nil {
+		return "", fmt.Errorf("failed securing credentials directory: %s", err)
+	}
+
+	file, err := ioutil.TempFile(credentialsDir, "credentials-")
+	if err != nil {
+		return "", fmt.Errorf("failed creating credentials file: %s", err)
+	}
+	defer file.Close()
+
+	var content strings.Builder
+	for _, key := range []string{"username", "password", "domain"} {
+		// mount.cifs reads everything up to the end of the line, so a value must not span lines
+		value := strings.Trim(secrets[key], "\r\n")
+		if key == "domain" && value == "" {
+			continue
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			_ = os.Remove(file.Name())
+			return "", fmt.Errorf("secret %s must not contain line breaks", key)
+		}
+		content.WriteString(fmt.Sprintf("%s=%s\n", key, value))
+	}
+
+	if _, err := file.WriteString(content.String()); err != nil {
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("failed writing credentials file: %s", err)
+	}
+
+	return file.Name(), nil
+}
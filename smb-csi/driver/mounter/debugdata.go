@@ -0,0 +1,132 @@
+package mounter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const cifsDebugDataPath = "/proc/fs/cifs/DebugData"
+
+// SessionSecurity is what the SMB session of a mount negotiated
+type SessionSecurity struct {
+	Signed    bool
+	Encrypted bool
+}
+
+var (
+	// A server connection starts a new block, e.g. "1) ConnectionId: 0x1 Hostname: server" or "1) Name: 10.0.0.1 Uses: 1"
+	connectionLine = regexp.MustCompile(`^\d+\) (ConnectionId|Name):`)
+	// A session of the connection, indented, e.g. "1) Address: 10.0.0.1 Uses: 1" or "1) Name: 10.0.0.1 Domain: CORP"
+	sessionLine = regexp.MustCompile(`^\s+\d+\) (Address|Name):`)
+	// A tree connect of the session, indented, e.g. "1) \\server\share Mounts: 1" or "0) IPC: \\server\IPC$"
+	treeLine      = regexp.MustCompile(`^\s+\d+\) (IPC: )?\\\\`)
+	signedWord    = regexp.MustCompile(`(?i)\bsigned\b`)
+	encryptedWord = regexp.MustCompile(`(?i)\bencrypted\b`)
+)
+
+// securityFlags are the signed and encrypted flags printed for a connection, session or tree connect
+type securityFlags struct {
+	signed    bool
+	encrypted bool
+}
+
+func (f *securityFlags) add(line string) {
+	f.signed = f.signed || signedWord.MatchString(line)
+	f.encrypted = f.encrypted || encryptedWord.MatchString(line)
+}
+
+// sharedTree is a tree connect of the share together with the session and connection it belongs to
+type sharedTree struct {
+	connection *securityFlags
+	session    *securityFlags
+	tree       *securityFlags
+}
+
+func (t sharedTree) security() SessionSecurity {
+	var security SessionSecurity
+	for _, flags := range []*securityFlags{t.connection, t.session, t.tree} {
+		if flags != nil {
+			security.Signed = security.Signed || flags.signed
+			security.Encrypted = security.Encrypted || flags.encrypted
+		}
+	}
+	return security
+}
+
+// GetSessionSecurity returns the security of the session the cifs source like //server/share/dir is mounted with
+func (*BaseMounter) GetSessionSecurity(source string) (*SessionSecurity, error) {
+	file, err := os.Open(cifsDebugDataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseSessionSecurity(file, source)
+}
+
+// ParseSessionSecurity finds the tree connects of the share of the source in the format of /proc/fs/cifs/DebugData.
+// The flags of a tree connect are those printed for it, its session and its connection, never those of other
+// sessions to the same server. The format differs between kernel versions, so only the signed and encrypted flags are looked at.
+// If the share is connected by several sessions, e.g. for different users, all of them have to be signed or encrypted.
+func ParseSessionSecurity(reader io.Reader, source string) (*SessionSecurity, error) {
+
+	// The share is listed as \\server\share, without the directory the source may point to
+	parts := strings.SplitN(strings.TrimLeft(strings.Replace(source, `\`, "/", -1), "/"), "/", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid cifs source %s", source)
+	}
+	wanted := strings.ToLower(`\\` + parts[0] + `\` + parts[1])
+
+	var trees []sharedTree
+	var connection, session, tree *securityFlags
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case connectionLine.MatchString(line):
+			connection, session, tree = &securityFlags{}, nil, nil
+		case sessionLine.MatchString(line):
+			session, tree = &securityFlags{}, nil
+		case treeLine.MatchString(line):
+			tree = &securityFlags{}
+			if isTree(line, wanted) {
+				trees = append(trees, sharedTree{connection: connection, session: session, tree: tree})
+			}
+		}
+
+		switch {
+		case tree != nil:
+			tree.add(line)
+		case session != nil:
+			session.add(line)
+		case connection != nil:
+			connection.add(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(trees) == 0 {
+		return nil, fmt.Errorf("no session of %s found in %s", source, cifsDebugDataPath)
+	}
+
+	security := trees[0].security()
+	for _, other := range trees[1:] {
+		otherSecurity := other.security()
+		security.Signed = security.Signed && otherSecurity.Signed
+		security.Encrypted = security.Encrypted && otherSecurity.Encrypted
+	}
+	return &security, nil
+}
+
+func isTree(line string, tree string) bool {
+	for _, field := range strings.Fields(strings.ToLower(line)) {
+		if strings.TrimRight(field, `\`) == tree {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package mounter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// Two sessions to the same server, only the one of user alice is encrypted
+const debugData = `Display Internal CIFS Data Structures for Debugging
+---------------------------------------------------
+CIFS Version 2.33
+Servers:
+1) ConnectionId: 0x1 Hostname: fileserver
+Number of credits: 8190 Dialect 0x311
+TCP status: 1 Instance: 1
+Local Users To Server: 2 SecMode: 0x1 Req On Wire: 0 Encryption: 0
+
+	Sessions:
+	1) Address: 10.0.0.1 Uses: 1 Capability: 0x300067	Session Status: 1
+	Security type: RawNTLMSSP  SessionId: 0x1 encrypted
+	User: 1000 Cred User: 0
+
+	Shares:
+	0) IPC: \\fileserver\IPC$ Mounts: 1 DevInfo: 0x0 Attributes: 0x0
+	1) \\fileserver\secure Mounts: 1 DevInfo: 0x20 Attributes: 0x1006f
+
+	2) Address: 10.0.0.1 Uses: 1 Capability: 0x300067	Session Status: 1
+	Security type: RawNTLMSSP  SessionId: 0x2
+	User: 1001 Cred User: 0
+
+	Shares:
+	0) IPC: \\fileserver\IPC$ Mounts: 1 DevInfo: 0x0 Attributes: 0x0
+	1) \\fileserver\share Mounts: 1 DevInfo: 0x20 Attributes: 0x1006f
+2) ConnectionId: 0x2 Hostname: signing
+Number of credits: 8190 Dialect 0x300 signed
+
+	Sessions:
+	1) Address: 10.0.0.2 Uses: 1 Capability: 0x300067	Session Status: 1
+	Security type: RawNTLMSSP  SessionId: 0x3
+
+	Shares:
+	1) \\signing\share Mounts: 1 DevInfo: 0x20 Attributes: 0x1006f
+`
+
+func TestParseSessionSecurity_OnlyFlagsOfTheSessionOfTheShare(t *testing.T) {
+	security, err := ParseSessionSecurity(strings.NewReader(debugData), "//fileserver/secure/testID")
+	assert.NoError(t, err)
+	assert.True(t, security.Encrypted)
+
+	security, err = ParseSessionSecurity(strings.NewReader(debugData), "//FileServer/share/testID")
+	assert.NoError(t, err)
+	assert.False(t, security.Encrypted)
+	assert.False(t, security.Signed)
+
+	// Signing is negotiated for the whole connection
+	security, err = ParseSessionSecurity(strings.NewReader(debugData), `\\signing\share`)
+	assert.NoError(t, err)
+	assert.True(t, security.Signed)
+	assert.False(t, security.Encrypted)
+}
+
+func TestParseSessionSecurity_ShareNotConnected(t *testing.T) {
+	_, err := ParseSessionSecurity(strings.NewReader(debugData), "//fileserver/other")
+	assert.Error(t, err)
+}
@@ -1,28 +1,63 @@
 package mounter
 
 import (
+	"context"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"k8s.io/klog/v2"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/metrics"
+	"smb-csi/driver/tracing"
 	"strings"
+	"time"
 )
 
 type Mounter interface {
 	GetFilesystemInfo(path string) (*unix.Statfs_t, error)
 	PathExists(path string) bool
 	CreateDir(path string, mode os.FileMode) error
-	DeleteDir(path string) error
-	Mount(src string, target string, mountOptions []string) error
-	AuthMount(source string, targetPath string, secrets map[string]string, mountFlags []string) error
-	BindMount(src string, target string) error
-	Unmount(target string) error
+	SetPermissions(path string, mode os.FileMode, uid int, gid int) error
+	GetPermissions(path string) (os.FileMode, int, int, error)
+	RemoveMountPoint(path string) error
+	Mount(ctx context.Context, src string, target string, mountOptions []string) error
+	AuthMount(ctx context.Context, source string, targetPath string, secrets map[string]string, mountFlags []string) error
+	KerberosMount(ctx context.Context, source string, targetPath string, credentialCache string, mountFlags []string) error
+	BindMount(ctx context.Context, src string, target string, readOnly bool) error
+	Unmount(ctx context.Context, target string) error
+	DetachMount(ctx context.Context, target string) error
+	IsMountPoint(path string) (bool, error)
+	GetMount(path string) (*MountInfo, error)
+	GetBindMounts(path string) ([]MountInfo, error)
+	GetSessionSecurity(source string) (*SessionSecurity, error)
 }
 
 type BaseMounter struct {}
 
+// Dialect of AuthMount and KerberosMount if the mount flags have no vers option
+const defaultVersion = "3.0"
+
+// Errors of mount.cifs (see mount.cifs(8) and the kernel log) if the server does not speak the requested dialect.
+// "Invalid argument" and "Host is down" are left out, a bad mount option or an unreachable server would be retried with every dialect.
+var dialectErrors = []string{"Operation not supported", "Protocol not supported"}
+
+// IsDialectError reports if a mount failed because the server rejected the dialect of the vers option
+func IsDialectError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, dialectError := range dialectErrors {
+		if strings.Contains(err.Error(), dialectError) {
+			return true
+		}
+	}
+	return false
+}
+
 func NewMounter() *Mounter {
 	var baseMounter Mounter
 	baseMounter = &BaseMounter{}
@@ -51,31 +86,97 @@ func (*BaseMounter) CreateDir(path string, mode os.FileMode) error {
 	return nil
 }
 
-func (*BaseMounter) DeleteDir(path string) error {
-	if deleteDirErr := os.RemoveAll(path); deleteDirErr != nil {
-		return deleteDirErr
+// SetPermissions applies mode and ownership, a negative uid or gid is left unchanged
+func (*BaseMounter) SetPermissions(path string, mode os.FileMode, uid int, gid int) error {
+	if chmodErr := os.Chmod(path, mode); chmodErr != nil {
+		return chmodErr
+	}
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+	if chownErr := os.Lchown(path, uid, gid); chownErr != nil {
+		return chownErr
+	}
+	return nil
+}
+
+func (*BaseMounter) GetPermissions(path string) (os.FileMode, int, int, error) {
+	var stat unix.Stat_t
+	if statErr := unix.Stat(path, &stat); statErr != nil {
+		return 0, 0, 0, statErr
+	}
+	return os.FileMode(stat.Mode & 0777), int(stat.Uid), int(stat.Gid), nil
+}
+
+// RemoveMountPoint removes the empty directory of an unmounted mount point.
+// Nothing is deleted recursively: a path which is still mounted, has mounts below it or is not empty
+// is returned as error, as removing it would delete the data on the share.
+func (*BaseMounter) RemoveMountPoint(path string) error {
+
+	mounts, err := ListMounts()
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed reading mount table: %s", err.Error())
+	}
+	path = filepath.Clean(path)
+	for _, mount := range mounts {
+		if mount.MountPoint == path || strings.HasPrefix(mount.MountPoint, path+"/") {
+			return status.Errorf(codes.Internal, "Refusing to remove %s, %s is still mounted from %s", path, mount.MountPoint, mount.Source)
+		}
+	}
+
+	if removeErr := os.Remove(path); removeErr != nil {
+		if os.IsNotExist(removeErr) {
+			return nil
+		}
+		return status.Errorf(codes.Internal, "Failed removing mount point %s: %s", path, removeErr.Error())
 	}
 	return nil
 }
 
-func (*BaseMounter) Mount(src string, target string, mountOptions []string) error {
+func (*BaseMounter) Mount(ctx context.Context, src string, target string, mountOptions []string) error {
+	return mountCifs(ctx, src, target, mountOptions, nil)
+}
+
+// mountCifs runs mount.cifs, env is added to the environment of the mount command
+func mountCifs(ctx context.Context, src string, target string, mountOptions []string, env []string) (err error) {
+	started := time.Now()
+	_, span := tracing.Start(ctx, "mount.cifs", attribute.String("source", src), attribute.String("target", target))
+	defer func() {
+		metrics.ObserveMount("mount", CifsServer(src), started, err)
+		tracing.End(span, err)
+	}()
 
 	//Check if the target path exist, else create it
 	if createDirErr := os.MkdirAll(target, os.ModeDir); createDirErr != nil {
 		return status.Errorf(codes.Internal, "Failed creating mount directory: %s,%s", createDirErr.Error(), target)
 	}
 
-	// Build string from mountOptions array, separated by ","
-	mountOptionsString := strings.Join(mountOptions, ",")
+	// mount.cifs is used instead of the mount syscall, as only it understands the credentials option
+	args := []string{"-t", "cifs"}
+	if len(mountOptions) > 0 {
+		args = append(args, "-o", strings.Join(mountOptions, ","))
+	}
+	args = append(args, src, target)
 
-	// Try to mount directory, else try to remove the created mounting-point directory and return error
-	if mountErr := unix.Mount(src, target, "cifs", 0, mountOptionsString); mountErr != nil {
-		return status.Errorf(codes.Internal,"Failed mounting directory: %s", mountErr.Error())
+	log := logging.FromContext(ctx, "mounter").WithValues("source", src, "target", target)
+	log.V(4).Info("Mounting share", "options", strings.Join(mountOptions, ","))
+	cmd := exec.Command("mount", args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if output, mountErr := cmd.CombinedOutput(); mountErr != nil {
+		log.Error(mountErr, "Mounting share failed", "output", strings.TrimSpace(string(output)))
+		return status.Errorf(codes.Internal,"Failed mounting directory: %s: %s", mountErr.Error(), strings.TrimSpace(string(output)))
 	}
 	return nil
 }
 
-func (*BaseMounter) BindMount(src string, target string) error {
+// BindMount bind mounts the source at the target. A read-only bind mount is remounted read-only,
+// as the MS_RDONLY flag is ignored when creating a bind mount, and verified in the mount table.
+func (m *BaseMounter) BindMount(ctx context.Context, src string, target string, readOnly bool) (err error) {
+	_, span := tracing.Start(ctx, "bind mount", attribute.String("source", src), attribute.String("target", target), attribute.Bool("readOnly", readOnly))
+	defer func() { tracing.End(span, err) }()
+	logging.FromContext(ctx, "mounter").V(4).Info("Bind mounting", "source", src, "target", target, "readOnly", readOnly)
 
 	//Check if the source path exist
 	if _, statSourceErr := os.Stat(src); statSourceErr != nil {
@@ -89,20 +190,56 @@ func (*BaseMounter) BindMount(src string, target string) error {
 
 	// Try to mount directory, else try to remove the created mounting-point directory and return error
 	if mountErr := unix.Mount(src, target, "bind", unix.MS_BIND, ""); mountErr != nil {
-		if deleteDirErr := os.RemoveAll(target); deleteDirErr == nil {
-			return status.Error(codes.Internal,"Failed cleanup after mounting failed")
+		// Only the empty mount point is removed, never anything below it
+		if deleteDirErr := os.Remove(target); deleteDirErr != nil && !os.IsNotExist(deleteDirErr) {
+			return status.Errorf(codes.Internal, "Failed mounting directory: %s, cleanup failed: %s", mountErr.Error(), deleteDirErr.Error())
+		}
+		return status.Errorf(codes.Internal, "Failed mounting directory: %s", mountErr.Error())
+	}
+
+	if readOnly {
+		if err := m.remountReadOnly(target); err != nil {
+			// The writable bind mount must not stay around
+			if unmountErr := unix.Unmount(target, 0); unmountErr != nil {
+				return status.Errorf(codes.Internal, "%s, removing the writable bind mount failed: %s", err.Error(), unmountErr.Error())
+			}
+			_ = os.Remove(target)
+			return err
 		}
-		return status.Error(codes.Internal,"Failed mounting directory")
 	}
 
 	return nil
 }
 
-func (*BaseMounter) Unmount(target string) error {
+func (m *BaseMounter) remountReadOnly(target string) error {
+	if err := unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, ""); err != nil {
+		return status.Errorf(codes.Internal, "Failed remounting %s read-only: %s", target, err.Error())
+	}
+	mount, err := m.GetMount(target)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed reading mount table: %s", err.Error())
+	}
+	if mount == nil || !mount.IsReadOnly() {
+		return status.Errorf(codes.Internal, "Remounting %s read-only did not take effect", target)
+	}
+	return nil
+}
+
+func (m *BaseMounter) Unmount(ctx context.Context, target string) (err error) {
+	_, span := tracing.Start(ctx, "unmount", attribute.String("target", target))
+	defer func() { tracing.End(span, err) }()
 
-	if _, statErr := os.Stat(target); statErr != nil { return nil }
-	klog.Infof("Target Unmounting: %s", target)
-	if unmountErr := unix.Unmount(target, 0); unmountErr != nil {
+	// Only the mount table tells reliably if there is something to unmount, stat may fail on a broken mount
+	mount, err := m.GetMount(target)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed reading mount table: %s", err.Error())
+	}
+	if mount == nil { return nil }
+	logging.FromContext(ctx, "mounter").Info("Unmounting", "target", target)
+	started := time.Now()
+	unmountErr := unix.Unmount(target, 0)
+	observeUnmount("unmount", mount, started, unmountErr)
+	if unmountErr != nil {
 		return unmountErr
 		//return status.Error(codes.Internal,"Failed unmounting directory")
 	}
@@ -110,25 +247,112 @@ func (*BaseMounter) Unmount(target string) error {
 	return nil
 }
 
-func (m *BaseMounter) AuthMount(source string, targetPath string, secrets map[string]string, mountFlags []string) error {
+// DetachMount lazily unmounts the target, which also works while a broken cifs mount is busy or does not respond
+func (m *BaseMounter) DetachMount(ctx context.Context, target string) (err error) {
+	_, span := tracing.Start(ctx, "detach mount", attribute.String("target", target))
+	defer func() { tracing.End(span, err) }()
+	mount, err := m.GetMount(target)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed reading mount table: %s", err.Error())
+	}
+	if mount == nil { return nil }
+	logging.FromContext(ctx, "mounter").Info("Detaching mount", "target", target)
+	started := time.Now()
+	err = unix.Unmount(target, unix.MNT_DETACH)
+	observeUnmount("detach", mount, started, err)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed detaching %s: %s", target, err.Error())
+	}
+	return nil
+}
+
+// observeUnmount records the duration of unmounting a cifs mount, bind mounts of a cifs mount included
+func observeUnmount(operation string, mount *MountInfo, started time.Time, err error) {
+	if mount.FsType == "cifs" {
+		metrics.ObserveMount(operation, CifsServer(mount.Source), started, err)
+	}
+}
+
+func (m *BaseMounter) IsMountPoint(path string) (bool, error) {
+	mount, err := m.GetMount(path)
+	if err != nil {
+		return false, err
+	}
+	return mount != nil, nil
+}
+
+// GetMount returns the topmost mount at the path or nil, if the path is no mount point
+func (*BaseMounter) GetMount(path string) (*MountInfo, error) {
+	mounts, err := ListMounts()
+	if err != nil {
+		return nil, err
+	}
+	return findMount(mounts, path), nil
+}
+
+// GetBindMounts returns the other mounts of the filesystem mounted at the path, like the bind mounts of a stage mount
+func (*BaseMounter) GetBindMounts(path string) ([]MountInfo, error) {
+	mounts, err := ListMounts()
+	if err != nil {
+		return nil, err
+	}
+	mount := findMount(mounts, path)
+	if mount == nil {
+		return nil, nil
+	}
+	var bindMounts []MountInfo
+	for _, other := range mounts {
+		if other.MajorMinor == mount.MajorMinor && other.Root == mount.Root && other.MountPoint != mount.MountPoint {
+			bindMounts = append(bindMounts, other)
+		}
+	}
+	return bindMounts, nil
+}
+
+// AuthMount mounts the cifs source with the credentials from the secrets.
+// The credentials are handed to mount.cifs in a root-only file, which is removed right after mounting.
+func (m *BaseMounter) AuthMount(ctx context.Context, source string, targetPath string, secrets map[string]string, mountFlags []string) error {
+
+	log := logging.FromContext(ctx, "mounter")
 
 	// Check if  username (optional) is present, else log that no username was provided
-	username, isUsernamePresent := secrets["username"]
-	if !isUsernamePresent {
-		klog.Info("No username specified in secrets")
+	if _, isUsernamePresent := secrets["username"]; !isUsernamePresent {
+		log.Info("No username specified in secrets", "source", source)
 	}
 
 	// Check if  password (optional) is present, else log that no password was provided
-	password, isPasswordPresent := secrets["password"]
-	if !isPasswordPresent {
-		klog.Info("No password specified in secrets")
+	if _, isPasswordPresent := secrets["password"]; !isPasswordPresent {
+		log.Info("No password specified in secrets", "source", source)
 	}
 
-	var mountOptions []string
-	mountOptions = append(mountOptions, fmt.Sprintf("username=%s", username))
-	mountOptions = append(mountOptions, fmt.Sprintf("password=%s", password))
-	mountOptions = append(mountOptions, fmt.Sprintf("vers=%s", "3.0"))
-	if mountFlags != nil && len(mountFlags) > 0 { mountOptions = append(mountOptions, mountFlags...) }
+	credentialsFile, err := writeCredentialsFile(secrets)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Failed passing credentials: %s", err.Error())
+	}
+	defer os.Remove(credentialsFile)
+
+	// The mount flags override the defaults, but never the credentials
+	defaultOptions := []string{fmt.Sprintf("vers=%s", defaultVersion)}
+	credentialOptions := []string{fmt.Sprintf("credentials=%s", credentialsFile)}
+	mountOptions, err := MergeMountFlags(defaultOptions, mountFlags, credentialOptions)
+	if err != nil {
+		return err
+	}
+
+	return m.Mount(ctx, source, targetPath, mountOptions)
+}
+
+// KerberosMount mounts the cifs source with sec=krb5, using the tickets in the credential cache.
+// The kernel asks cifs.upcall for a ticket, which runs as the cruid, the owner of the cache,
+// and finds the cache in the environment of the mount process.
+func (*BaseMounter) KerberosMount(ctx context.Context, source string, targetPath string, credentialCache string, mountFlags []string) error {
+
+	defaultOptions := []string{"sec=krb5", fmt.Sprintf("vers=%s", defaultVersion)}
+	credentialOptions := []string{fmt.Sprintf("cruid=%d", os.Getuid())}
+	mountOptions, err := MergeMountFlags(defaultOptions, mountFlags, credentialOptions)
+	if err != nil {
+		return err
+	}
 
-	return m.Mount(source, targetPath, mountOptions)
+	return mountCifs(ctx, source, targetPath, mountOptions, []string{"KRB5CCNAME=" + credentialCache})
 }
@@ -0,0 +1,16 @@
+package mounter
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIsDialectError(t *testing.T) {
+	assert.True(t, IsDialectError(errors.New("mount error(95): Operation not supported")))
+	assert.True(t, IsDialectError(errors.New("mount error(93): Protocol not supported")))
+	assert.False(t, IsDialectError(errors.New("mount error(22): Invalid argument")))
+	assert.False(t, IsDialectError(errors.New("mount error(112): Host is down")))
+	assert.False(t, IsDialectError(errors.New("mount error(13): Permission denied")))
+	assert.False(t, IsDialectError(nil))
+}
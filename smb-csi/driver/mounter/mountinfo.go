@@ -0,0 +1,214 @@
+package mounter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// MountInfo is one line of /proc/self/mountinfo, see proc(5)
+type MountInfo struct {
+	ID       int
+	ParentID int
+	// major:minor of the mounted filesystem, shared by a mount and its bind mounts
+	MajorMinor string
+	// Directory of the filesystem which forms the root of this mount
+	Root       string
+	MountPoint string
+	// Per mount options like ro or rw
+	MountOptions []string
+	FsType       string
+	Source       string
+	// Per superblock options, e.g. the cifs options the share was mounted with
+	SuperOptions []string
+}
+
+// IsReadOnly reports if the mount itself is read only
+func (m *MountInfo) IsReadOnly() bool {
+	return hasOption(m.MountOptions, "ro")
+}
+
+// Option returns the value of a superblock option, e.g. vers for cifs mounts
+func (m *MountInfo) Option(name string) (string, bool) {
+	for _, option := range m.SuperOptions {
+		if option == name {
+			return "", true
+		}
+		if strings.HasPrefix(option, name+"=") {
+			return strings.TrimPrefix(option, name+"="), true
+		}
+	}
+	return "", false
+}
+
+// ConflictingOptions compares the requested options with the superblock options of the mount.
+// Only the given option names are compared, as the kernel adds many options on its own.
+// It returns the names of the options with a different value.
+func (m *MountInfo) ConflictingOptions(requested []string, names ...string) []string {
+	var conflicting []string
+	for _, name := range names {
+		for _, option := range requested {
+			if !strings.HasPrefix(option, name+"=") {
+				continue
+			}
+			wanted := strings.TrimPrefix(option, name+"=")
+			actual, isOptionPresent := m.Option(name)
+			if !isOptionPresent || !sameOptionValue(name, wanted, actual) {
+				conflicting = append(conflicting, name)
+			}
+		}
+	}
+	return conflicting
+}
+
+func sameOptionValue(name string, a string, b string) bool {
+	// Modes are printed as 0755 by the kernel, but may be requested as 755
+	if strings.HasSuffix(name, "_mode") {
+		modeA, errA := strconv.ParseUint(a, 8, 32)
+		modeB, errB := strconv.ParseUint(b, 8, 32)
+		return errA == nil && errB == nil && modeA == modeB
+	}
+	return strings.EqualFold(a, b)
+}
+
+// ListMounts returns all mounts of the mount namespace of the driver
+func ListMounts() ([]MountInfo, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseMountInfo(file)
+}
+
+// ParseMountInfo parses the format of /proc/self/mountinfo
+func ParseMountInfo(reader io.Reader) ([]MountInfo, error) {
+
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(line)
+		separator := -1
+		for index, field := range fields {
+			if field == "-" {
+				separator = index
+				break
+			}
+		}
+		if separator < 6 || len(fields) < separator+3 {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", line)
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed mount id in mountinfo line %q: %s", line, err)
+		}
+		parentID, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed parent id in mountinfo line %q: %s", line, err)
+		}
+
+		mount := MountInfo{
+			ID:           id,
+			ParentID:     parentID,
+			MajorMinor:   fields[2],
+			Root:         unescapeMountInfo(fields[3]),
+			MountPoint:   unescapeMountInfo(fields[4]),
+			MountOptions: strings.Split(fields[5], ","),
+			FsType:       fields[separator+1],
+			Source:       unescapeMountInfo(fields[separator+2]),
+		}
+		if len(fields) > separator+3 {
+			mount.SuperOptions = strings.Split(fields[separator+3], ",")
+		}
+		mounts = append(mounts, mount)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mounts, nil
+}
+
+// findMount returns the topmost mount at the path or nil, if the path is no mount point
+func findMount(mounts []MountInfo, path string) *MountInfo {
+	path = filepath.Clean(path)
+	var found *MountInfo
+	for index := range mounts {
+		// Later entries are mounted on top of earlier ones
+		if mounts[index].MountPoint == path {
+			found = &mounts[index]
+		}
+	}
+	return found
+}
+
+// unescapeMountInfo decodes the octal escapes (\040 for space etc.) used by the kernel in mountinfo
+func unescapeMountInfo(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var builder strings.Builder
+	for index := 0; index < len(field); index++ {
+		if field[index] == '\\' && index+3 < len(field) {
+			if value, err := strconv.ParseUint(field[index+1:index+4], 8, 8); err == nil {
+				builder.WriteByte(byte(value))
+				index += 3
+				continue
+			}
+		}
+		builder.WriteByte(field[index])
+	}
+	return builder.String()
+}
+
+func hasOption(options []string, name string) bool {
+	for _, option := range options {
+		if option == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CifsSource builds a cifs source like //server/share/dir from its components.
+// The server and share may be given as UNC or DFS paths themselves, e.g. a share dfs/team or a server \\corp.example.
+func CifsSource(components ...string) string {
+	var parts []string
+	for _, component := range components {
+		if component = strings.Trim(strings.Replace(component, `\`, "/", -1), "/"); component != "" {
+			parts = append(parts, component)
+		}
+	}
+	return "//" + strings.Join(parts, "/")
+}
+
+// CifsServer returns the server of a cifs source like //server/share/dir in lower case
+func CifsServer(source string) string {
+	source = strings.TrimLeft(strings.Replace(source, `\`, "/", -1), "/")
+	if end := strings.Index(source, "/"); end >= 0 {
+		source = source[:end]
+	}
+	return strings.ToLower(source)
+}
+
+// SameCifsSource compares two cifs sources like //server/share/dir, ignoring case and the kind of slashes
+func SameCifsSource(a string, b string) bool {
+	normalize := func(source string) string {
+		source = strings.Replace(source, `\`, "/", -1)
+		return strings.ToLower(strings.TrimRight(source, "/"))
+	}
+	return normalize(a) == normalize(b)
+}
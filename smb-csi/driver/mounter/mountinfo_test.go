@@ -0,0 +1,52 @@
+package mounter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const mountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+36 22 0:45 / /var/lib/kubelet/staging rw,relatime shared:20 - cifs //fileserver/share/testID rw,vers=3.1.1,sec=ntlmssp,uid=1000,dir_mode=0755
+37 22 0:45 / /var/lib/kubelet/pods/pod\040one/volume ro,relatime shared:20 - cifs //fileserver/share/testID rw,vers=3.1.1,sec=ntlmssp,uid=1000,dir_mode=0755
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := ParseMountInfo(strings.NewReader(mountInfo))
+	assert.NoError(t, err)
+	assert.Len(t, mounts, 3)
+
+	staging := mounts[1]
+	assert.Equal(t, 36, staging.ID)
+	assert.Equal(t, 22, staging.ParentID)
+	assert.Equal(t, "0:45", staging.MajorMinor)
+	assert.Equal(t, "/var/lib/kubelet/staging", staging.MountPoint)
+	assert.Equal(t, "cifs", staging.FsType)
+	assert.Equal(t, "//fileserver/share/testID", staging.Source)
+	assert.False(t, staging.IsReadOnly())
+	version, isVersionPresent := staging.Option("vers")
+	assert.True(t, isVersionPresent)
+	assert.Equal(t, "3.1.1", version)
+	assert.Empty(t, staging.ConflictingOptions([]string{"uid=1000", "dir_mode=755"}, "uid", "dir_mode"))
+	assert.Equal(t, []string{"uid"}, staging.ConflictingOptions([]string{"uid=1001"}, "uid", "dir_mode"))
+
+	// The space in the mount point is escaped by the kernel
+	bind := mounts[2]
+	assert.Equal(t, "/var/lib/kubelet/pods/pod one/volume", bind.MountPoint)
+	assert.True(t, bind.IsReadOnly())
+	assert.Equal(t, &mounts[2], findMount(mounts, "/var/lib/kubelet/pods/pod one/volume/"))
+	assert.Nil(t, findMount(mounts, "/var/lib/kubelet"))
+}
+
+func TestParseMountInfo_Malformed(t *testing.T) {
+	_, err := ParseMountInfo(strings.NewReader("36 22 0:45 / /mnt rw\n"))
+	assert.Error(t, err)
+	_, err = ParseMountInfo(strings.NewReader("x 22 0:45 / /mnt rw shared:1 - cifs //server/share rw\n"))
+	assert.Error(t, err)
+}
+
+func TestCifsServer(t *testing.T) {
+	assert.Equal(t, "fileserver", CifsServer("//FileServer/share/dir"))
+	assert.Equal(t, "corp.example", CifsServer(`\\corp.example\dfs\team`))
+	assert.Equal(t, "fileserver", CifsServer("//fileserver"))
+}
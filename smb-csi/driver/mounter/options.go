@@ -0,0 +1,178 @@
+package mounter
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// MountOption is a single cifs mount option like ro or vers=3.0
+type MountOption struct {
+	Name     string
+	Value    string
+	HasValue bool
+}
+
+func (o MountOption) String() string {
+	if o.HasValue {
+		return o.Name + "=" + o.Value
+	}
+	return o.Name
+}
+
+// MountOptions keeps the options in the order they were given
+type MountOptions []MountOption
+
+// Options only the driver may set, as they carry or select the credentials of the secret
+var driverOwnedOptions = map[string]bool{
+	"username": true, "user": true, "password": true, "pass": true, "password2": true,
+	"credentials": true, "cred": true, "domain": true, "dom": true, "workgroup": true,
+	"cruid": true, "multiuser": true,
+}
+
+// Options which cancel each other, a later one replaces the other one
+var oppositeOptions = map[string]string{
+	"ro": "rw", "rw": "ro",
+	"hard": "soft", "soft": "hard",
+	"forceuid": "noforceuid", "noforceuid": "forceuid",
+	"forcegid": "noforcegid", "noforcegid": "forcegid",
+	"serverino": "noserverino", "noserverino": "serverino",
+	"perm": "noperm", "noperm": "perm",
+	"unix": "nounix", "nounix": "unix",
+	"brl": "nobrl", "nobrl": "brl",
+	"acl": "noacl", "noacl": "acl",
+	"mapchars": "nomapchars", "nomapchars": "mapchars",
+}
+
+// DefaultMountOptionsAllowlist are the options which may be set in the mountOptions of a StorageClass or PV
+var DefaultMountOptionsAllowlist = []string{
+	"ro", "rw", "vers", "sec", "uid", "gid", "forceuid", "forcegid", "noforceuid", "noforcegid",
+	"file_mode", "dir_mode", "perm", "noperm", "unix", "nounix", "serverino", "noserverino",
+	"cache", "actimeo", "acregmax", "acdirmax", "closetimeo", "rsize", "wsize", "bsize",
+	"brl", "nobrl", "acl", "noacl", "cifsacl", "mfsymlinks", "nosharesock", "iocharset",
+	"mapchars", "nomapchars", "mapposix", "nocase", "nostrictsync", "noatime", "relatime",
+	"nodev", "nosuid", "noexec", "hard", "soft", "echo_interval", "handletimeout",
+	"resilienthandles", "persistenthandles", "nohandlecache", "multichannel", "max_channels",
+	"seal", "sign",
+}
+
+// ParseMountOptions parses mount flags, each of which may hold several comma separated options.
+// An option given twice with different values or together with its opposite is an InvalidArgument error.
+func ParseMountOptions(mountFlags []string) (MountOptions, error) {
+	var options MountOptions
+	for _, flag := range mountFlags {
+		for _, field := range strings.Split(flag, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			option := MountOption{Name: field}
+			if index := strings.Index(field, "="); index >= 0 {
+				option = MountOption{Name: field[:index], Value: field[index+1:], HasValue: true}
+			}
+			option.Name = strings.ToLower(strings.TrimSpace(option.Name))
+			if option.Name == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid mount option %q", field)
+			}
+
+			if existing, isOptionPresent := options.Get(option.Name); isOptionPresent && existing.String() != option.String() {
+				return nil, status.Errorf(codes.InvalidArgument, "Mount option %s is set more than once with different values", option.Name)
+			}
+			if opposite, hasOpposite := oppositeOptions[option.Name]; hasOpposite && options.Has(opposite) {
+				return nil, status.Errorf(codes.InvalidArgument, "Mount options %s and %s contradict each other", opposite, option.Name)
+			}
+			if !options.Has(option.Name) {
+				options = append(options, option)
+			}
+		}
+	}
+	return options, nil
+}
+
+func (o MountOptions) Get(name string) (MountOption, bool) {
+	for _, option := range o {
+		if option.Name == name {
+			return option, true
+		}
+	}
+	return MountOption{}, false
+}
+
+func (o MountOptions) Has(name string) bool {
+	_, isOptionPresent := o.Get(name)
+	return isOptionPresent
+}
+
+// Strings returns the options in the format of the mount flags
+func (o MountOptions) Strings() []string {
+	flags := make([]string, 0, len(o))
+	for _, option := range o {
+		flags = append(flags, option.String())
+	}
+	return flags
+}
+
+// MergeMountOptions merges the options of several sources, with later sources taking precedence,
+// e.g. driver defaults, then the options derived from the StorageClass parameters, then the mountOptions of the PV.
+// An option replaces the one with the same name and its opposite.
+func MergeMountOptions(sources ...MountOptions) MountOptions {
+	var merged MountOptions
+	for _, source := range sources {
+		for _, option := range source {
+			var kept MountOptions
+			for _, existing := range merged {
+				if existing.Name != option.Name && existing.Name != oppositeOptions[option.Name] {
+					kept = append(kept, existing)
+				}
+			}
+			merged = append(kept, option)
+		}
+	}
+	return merged
+}
+
+// MergeMountFlags is MergeMountOptions for mount flags. Every source is parsed first,
+// so a malformed flag is an InvalidArgument error instead of being dropped.
+func MergeMountFlags(sources ...[]string) ([]string, error) {
+	var parsed []MountOptions
+	for _, source := range sources {
+		options, err := ParseMountOptions(source)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, options)
+	}
+	return MergeMountOptions(parsed...).Strings(), nil
+}
+
+// OptionPolicy decides which mount options users may set
+type OptionPolicy struct {
+	allowed map[string]bool
+}
+
+func NewOptionPolicy(allowlist []string) *OptionPolicy {
+	policy := &OptionPolicy{allowed: make(map[string]bool, len(allowlist))}
+	for _, name := range allowlist {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			policy.allowed[name] = true
+		}
+	}
+	return policy
+}
+
+// Validate parses the mount flags of a StorageClass or PV and rejects options which are forbidden or not allowlisted
+func (p *OptionPolicy) Validate(mountFlags []string) (MountOptions, error) {
+	options, err := ParseMountOptions(mountFlags)
+	if err != nil {
+		return nil, err
+	}
+	for _, option := range options {
+		if driverOwnedOptions[option.Name] {
+			return nil, status.Errorf(codes.InvalidArgument, "Mount option %s is not allowed, the credentials are taken from the secret", option.Name)
+		}
+		if !p.allowed[option.Name] {
+			return nil, status.Errorf(codes.InvalidArgument, "Mount option %s is not allowed, it is not in the mount options allowlist", option.Name)
+		}
+	}
+	return options, nil
+}
@@ -0,0 +1,21 @@
+package mounter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestMergeMountFlags_LaterSourceTakesPrecedence(t *testing.T) {
+	merged, err := MergeMountFlags([]string{"vers=3.0", "ro"}, []string{"rw,vers=3.1.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rw", "vers=3.1.1"}, merged)
+}
+
+func TestMergeMountFlags_MalformedFlag(t *testing.T) {
+	_, err := MergeMountFlags([]string{"vers=3.0"}, []string{"ro,rw"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = MergeMountFlags([]string{"=3.0"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
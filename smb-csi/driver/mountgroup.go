@@ -0,0 +1,347 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"path/filepath"
+	"smb-csi/driver/journal"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/metrics"
+	"smb-csi/driver/mounter"
+	"strconv"
+	"sync"
+)
+
+const (
+	// Modes giving the volume mount group write access, cifs defaults to 0755 for both
+	groupDirMode  = "0775"
+	groupFileMode = "0664"
+)
+
+// stagedVolume remembers how a volume was staged, so it can be mounted again for another volume mount group
+// or after the mount broke. Publish requests don't carry the node stage secret, so it is kept here sealed
+// until the volume is unstaged.
+type stagedVolume struct {
+	Source        string
+	StagingPath   string
+	SealedSecrets []byte
+	// Compared with existing mounts, which show them in their options
+	Username string
+	Domain   string
+	// Options derived from the StorageClass parameters and the mountOptions of the PV, which take precedence over the group
+	ParameterOptions []string
+	MountFlags       []string
+	SMBVersions      []string
+	// Dialect compared with existing mounts, empty if it is negotiated
+	PinnedVersion string
+	Transport     *transportSecurity
+	// Kerberos credential cache, empty for username and password
+	CredentialCache string
+	// Volume mount group of the stage mount, empty if none was requested
+	Group string
+	// Published target paths per volume mount group with its own stage mount
+	GroupTargets map[string]map[string]bool
+	// Failed remounts per broken stage mount since it was last working
+	RemountAttempts map[string]int
+	// Published targets per broken stage mount, which have to be bound to its new mount
+	RemountTargets map[string][]mounter.MountInfo
+}
+
+// mountOptions returns the options for a mount of the volume with the options of a volume mount group
+func (s *stagedVolume) mountOptions(groupOptions []string) ([]string, error) {
+	if err := s.checkGroupConflict(groupOptions); err != nil {
+		return nil, err
+	}
+	return mounter.MergeMountFlags(groupOptions, s.ParameterOptions, s.MountFlags)
+}
+
+// checkGroupConflict rejects a gid of the StorageClass or the mountOptions of the PV other than the volume mount group,
+// as it would take precedence and the pod would silently not get the group it asked for
+func (s *stagedVolume) checkGroupConflict(groupOptions []string) error {
+	parsedGroupOptions, err := mounter.ParseMountOptions(groupOptions)
+	if err != nil {
+		return err
+	}
+	group, isGroupPresent := parsedGroupOptions.Get("gid")
+	if !isGroupPresent {
+		return nil
+	}
+	for _, source := range [][]string{s.ParameterOptions, s.MountFlags} {
+		options, err := mounter.ParseMountOptions(source)
+		if err != nil {
+			return err
+		}
+		if gid, isGidPresent := options.Get("gid"); isGidPresent && gid.Value != group.Value {
+			return status.Errorf(codes.InvalidArgument, "gid %s of the StorageClass or the mountOptions conflicts with the volume mount group %s", gid.Value, group.Value)
+		}
+	}
+	return nil
+}
+
+// comparedOptions returns the options an existing mount of the volume has to have
+func (s *stagedVolume) comparedOptions(mountOptions []string) []string {
+	var compared []string
+	if s.CredentialCache != "" {
+		compared = append(compared, "sec=krb5")
+	} else {
+		compared = append(compared, fmt.Sprintf("username=%s", s.Username))
+		if s.Domain != "" {
+			compared = append(compared, fmt.Sprintf("domain=%s", s.Domain))
+		}
+	}
+	compared = append(compared, mountOptions...)
+	// A negotiated dialect may differ from the one tried first
+	if s.PinnedVersion != "" {
+		compared = append(compared, fmt.Sprintf("vers=%s", s.PinnedVersion))
+	}
+	return compared
+}
+
+type stagedVolumes struct {
+	mutex   sync.Mutex
+	volumes map[string]*stagedVolume
+}
+
+func newStagedVolumes() *stagedVolumes {
+	return &stagedVolumes{volumes: make(map[string]*stagedVolume)}
+}
+
+func (s *stagedVolumes) Get(volumeID string) (*stagedVolume, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	volume, isVolumePresent := s.volumes[volumeID]
+	return volume, isVolumePresent
+}
+
+func (s *stagedVolumes) Add(volumeID string, volume *stagedVolume) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.volumes[volumeID] = volume
+	s.updateStageMounts()
+}
+
+// List returns the staged volumes by volume ID
+func (s *stagedVolumes) List() map[string]*stagedVolume {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	volumes := make(map[string]*stagedVolume, len(s.volumes))
+	for volumeID, volume := range s.volumes {
+		volumes[volumeID] = volume
+	}
+	return volumes
+}
+
+func (s *stagedVolumes) Remove(volumeID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.volumes, volumeID)
+	s.updateStageMounts()
+}
+
+// AddGroupTarget records the target published from the stage mount of the volume mount group
+func (s *stagedVolumes) AddGroupTarget(volume *stagedVolume, group string, targetPath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if volume.GroupTargets[group] == nil {
+		volume.GroupTargets[group] = make(map[string]bool)
+	}
+	volume.GroupTargets[group][targetPath] = true
+	s.updateStageMounts()
+}
+
+// RemoveGroupTarget removes the target and returns the volume mount group, if it was the last target of its stage mount
+func (s *stagedVolumes) RemoveGroupTarget(volume *stagedVolume, targetPath string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for group, targets := range volume.GroupTargets {
+		if !targets[targetPath] {
+			continue
+		}
+		delete(targets, targetPath)
+		if len(targets) > 0 {
+			return "", false
+		}
+		delete(volume.GroupTargets, group)
+		s.updateStageMounts()
+		return group, true
+	}
+	return "", false
+}
+
+// updateStageMounts counts the stage mounts of the volumes and those of their volume mount groups
+func (s *stagedVolumes) updateStageMounts() {
+	count := 0
+	for _, volume := range s.volumes {
+		count += 1 + len(volume.GroupTargets)
+	}
+	metrics.StageMounts.Set(float64(count))
+}
+
+// volumeMountGroupOptions translates the volume mount group (the fsGroup of the pod) into cifs options,
+// as files on the share can't be chowned to it. The modes in the mount flags take precedence, a different gid is rejected.
+func volumeMountGroupOptions(group string) ([]string, error) {
+	if group == "" {
+		return nil, nil
+	}
+	if _, err := strconv.ParseUint(group, 10, 31); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid volume mount group %s, must be a numeric gid", group)
+	}
+	return []string{
+		fmt.Sprintf("gid=%s", group),
+		"forcegid",
+		fmt.Sprintf("dir_mode=%s", groupDirMode),
+		fmt.Sprintf("file_mode=%s", groupFileMode),
+	}, nil
+}
+
+// groupStagingPath is the stage mount of a volume for a volume mount group other than the one it was staged with.
+// It is next to the staging path, so it is below the kubelet directory shared with the host as well.
+func groupStagingPath(stagingPath string, group string) string {
+	return filepath.Clean(stagingPath) + "-gid-" + group
+}
+
+// mountStaged mounts the volume at the path and checks the transport security of the mount
+func (d *Driver) mountStaged(ctx context.Context, staged *stagedVolume, path string, mountOptions []string) error {
+
+	var mount func(versionOptions []string) error
+	if staged.CredentialCache != "" {
+		mount = func(versionOptions []string) error {
+			return d.Mounter.KerberosMount(ctx, staged.Source, path, staged.CredentialCache, versionOptions)
+		}
+	} else {
+		secrets, err := d.secretBox.Open(staged.SealedSecrets)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Failed opening the secrets of %s: %s", staged.Source, err.Error())
+		}
+		mount = func(versionOptions []string) error {
+			return d.Mounter.AuthMount(ctx, staged.Source, path, secrets, versionOptions)
+		}
+	}
+
+	if _, err := negotiateSMBVersion(ctx, staged.SMBVersions, mountOptions, mount); err != nil {
+		logging.FromContext(ctx, "node").Error(err, "Mounting stage mount failed", "source", staged.Source, "path", path)
+		return err
+	}
+
+	// A server may accept seal or sign without enforcing them, such a mount must not be used
+	if err := d.verifyTransportSecurity(staged.Source, staged.Transport); err != nil {
+		logging.FromContext(ctx, "node").Error(err, "Verifying transport security failed", "source", staged.Source, "path", path)
+		d.unmountStaged(ctx, path)
+		return err
+	}
+	return nil
+}
+
+// unmountStaged unmounts a stage mount, which can't be used anyway, logging any error
+func (d *Driver) unmountStaged(ctx context.Context, path string) {
+	if err := d.Mounter.Unmount(ctx, path); err != nil {
+		logging.FromContext(ctx, "node").Error(err, "Unmounting stage mount failed", "path", path)
+	} else if err := d.Mounter.RemoveMountPoint(path); err != nil {
+		logging.FromContext(ctx, "node").Error(err, "Removing mount point failed", "path", path)
+	}
+}
+
+// stageForGroup returns the stage mount to publish the volume from for the volume mount group,
+// mounting the volume for the group if it was staged for another one
+func (d *Driver) stageForGroup(ctx context.Context, volumeID string, stagingPath string, group string, targetPath string) (string, error) {
+
+	staged, isStaged := d.stagedVolumes.Get(volumeID)
+	if group == "" || (isStaged && staged.Group == group) {
+		return stagingPath, nil
+	}
+	if !isStaged {
+		return d.stageForGroupAfterRestart(ctx, stagingPath, group)
+	}
+
+	groupOptions, err := volumeMountGroupOptions(group)
+	if err != nil {
+		return "", err
+	}
+	groupPath := groupStagingPath(stagingPath, group)
+	mountOptions, err := staged.mountOptions(groupOptions)
+	if err != nil {
+		return "", err
+	}
+
+	isMounted, err := d.isMountedFrom(groupPath, staged.Source, staged.comparedOptions(mountOptions))
+	if err != nil {
+		return "", err
+	}
+	if !isMounted {
+		if err := d.mountStaged(ctx, staged, groupPath, mountOptions); err != nil {
+			return "", err
+		}
+	}
+
+	d.stagedVolumes.AddGroupTarget(staged, group, targetPath)
+	return groupPath, nil
+}
+
+// stageForGroupAfterRestart returns the stage mount for a volume staged before a restart of the node plugin.
+// Its secrets are not known anymore, so no stage mount can be mounted for the volume mount group. A stage mount
+// of the group which survived the restart is used, otherwise the volume is published from its stage mount.
+func (d *Driver) stageForGroupAfterRestart(ctx context.Context, stagingPath string, group string) (string, error) {
+
+	groupPath := groupStagingPath(stagingPath, group)
+	groupMount, err := d.Mounter.GetMount(groupPath)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Failed reading mount table: %s", err.Error())
+	}
+	if groupMount != nil {
+		staging, err := d.Mounter.GetMount(stagingPath)
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "Failed reading mount table: %s", err.Error())
+		}
+		if staging != nil && mounter.SameCifsSource(groupMount.Source, staging.Source) {
+			return groupPath, nil
+		}
+	}
+
+	if d.Journal != nil {
+		if entry, isRecorded := d.Journal.Get(journal.KindStage, stagingPath); isRecorded && entry.Group == group {
+			return stagingPath, nil
+		}
+	}
+	logging.FromContext(ctx, "node").Info("Volume was staged before a restart for another volume mount group, it is published with the ownership it was staged with",
+		"group", group, "stagingPath", stagingPath)
+	return stagingPath, nil
+}
+
+// releaseGroupStage unmounts the stage mount of a volume mount group once its last target was unpublished
+func (d *Driver) releaseGroupStage(ctx context.Context, volumeID string, targetPath string) error {
+
+	staged, isStaged := d.stagedVolumes.Get(volumeID)
+	if !isStaged {
+		return nil
+	}
+	group, isLastTarget := d.stagedVolumes.RemoveGroupTarget(staged, targetPath)
+	if !isLastTarget {
+		return nil
+	}
+
+	groupPath := groupStagingPath(staged.StagingPath, group)
+	if err := d.Mounter.Unmount(ctx, groupPath); err != nil {
+		return err
+	}
+	return d.Mounter.RemoveMountPoint(groupPath)
+}
+
+// unstageGroups unmounts the stage mounts of all volume mount groups of the staging path.
+// They are found on disk, so mounts of a driver instance before a restart are unmounted as well.
+func (d *Driver) unstageGroups(ctx context.Context, stagingPath string) error {
+	groupPaths, err := filepath.Glob(groupStagingPath(stagingPath, "*"))
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed listing group stage mounts of %s: %s", stagingPath, err.Error())
+	}
+	for _, groupPath := range groupPaths {
+		if err := d.Mounter.Unmount(ctx, groupPath); err != nil {
+			return err
+		}
+		if err := d.Mounter.RemoveMountPoint(groupPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
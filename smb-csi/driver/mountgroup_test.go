@@ -0,0 +1,45 @@
+package driver
+
+import (
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"smb-csi/driver/mounter"
+	"testing"
+)
+
+func TestStagedVolume_StorageClassModesTakePrecedenceOverGroup(t *testing.T) {
+	ownershipOptions, err := ownershipMountOptions(map[string]string{ownershipKey: ownershipMount, dirModeKey: "0700", gidKey: "2000"}, nil)
+	assert.NoError(t, err)
+	groupOptions, err := volumeMountGroupOptions("2000")
+	assert.NoError(t, err)
+	staged := &stagedVolume{ParameterOptions: ownershipOptions, MountFlags: []string{"file_mode=0600"}}
+
+	mountOptions, err := staged.mountOptions(groupOptions)
+	assert.NoError(t, err)
+	options, err := mounter.ParseMountOptions(mountOptions)
+	assert.NoError(t, err)
+	dirMode, _ := options.Get("dir_mode")
+	assert.Equal(t, "0700", dirMode.Value)
+	gid, _ := options.Get("gid")
+	assert.Equal(t, "2000", gid.Value)
+	// The mountOptions of the PV take precedence over both
+	fileMode, _ := options.Get("file_mode")
+	assert.Equal(t, "0600", fileMode.Value)
+	assert.True(t, options.Has("forcegid"))
+}
+
+func TestStagedVolume_GidConflictingWithGroupIsRejected(t *testing.T) {
+	ownershipOptions, err := ownershipMountOptions(map[string]string{ownershipKey: ownershipMount, gidKey: "1000"}, nil)
+	assert.NoError(t, err)
+	groupOptions, err := volumeMountGroupOptions("2000")
+	assert.NoError(t, err)
+
+	_, err = (&stagedVolume{ParameterOptions: ownershipOptions}).mountOptions(groupOptions)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = (&stagedVolume{MountFlags: []string{"gid=1000"}}).mountOptions(groupOptions)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	// Without a volume mount group the gid is used as is
+	_, err = (&stagedVolume{ParameterOptions: ownershipOptions}).mountOptions(nil)
+	assert.NoError(t, err)
+}
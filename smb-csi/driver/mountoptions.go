@@ -0,0 +1,36 @@
+package driver
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// validateMountFlags checks the mountOptions of a StorageClass or PV against the mount options allowlist
+// and returns them normalized to one option per flag. sec and vers have to be values the parameters accept as well.
+func (d *Driver) validateMountFlags(mountFlags []string) ([]string, error) {
+	options, err := d.mountOptionPolicy.Validate(mountFlags)
+	if err != nil {
+		return nil, err
+	}
+	if sec, isSecPresent := options.Get(secKey); isSecPresent {
+		if _, err := securityMode(map[string]string{secKey: sec.Value}); err != nil {
+			return nil, err
+		}
+	}
+	if vers, isVersPresent := options.Get("vers"); isVersPresent && !isSMBVersion(vers.Value) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid mount option vers=%s, must be one of %s", vers.Value, strings.Join(smbVersions, ", "))
+	}
+	return options.Strings(), nil
+}
+
+// validateCapabilities checks the mount flags of all requested capabilities, so a volume is not provisioned with options no node accepts
+func (d *Driver) validateCapabilities(capabilities []*csi.VolumeCapability) error {
+	for _, capability := range capabilities {
+		if _, err := d.validateMountFlags(capability.GetMount().GetMountFlags()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,13 +2,14 @@ package driver
 
 import (
 	"context"
-	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/klog/v2"
-	"smb-csi/driver/healtchCheck"
+	"smb-csi/driver/journal"
+	"smb-csi/driver/kerberos"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/mounter"
 	"strings"
 )
 
@@ -18,7 +19,6 @@ func (d *Driver) NodeStageVolume(ctx context.Context, request *csi.NodeStageVolu
 	targetPath := request.GetStagingTargetPath()
 	volumeContext := request.GetVolumeContext()
 	secrets := request.GetSecrets()
-	mountFlags := request.GetVolumeCapability().GetMount().GetMountFlags()
 	volumeId := request.GetVolumeId()
 
 	// Check if source path is present
@@ -32,32 +32,113 @@ func (d *Driver) NodeStageVolume(ctx context.Context, request *csi.NodeStageVolu
 		return nil, status.Error(codes.InvalidArgument,"No smb-share source is present")
 	}
 
-	sourceMountPoint := "//" + strings.Join([]string{server, share, volumeId}, "/")
+	mountFlags, err := d.validateMountFlags(request.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, err
+	}
 
-	// Check if  username (optional) is present, else log that no username was provided
-	username, isUsernamePresent := secrets["username"]
-	if !isUsernamePresent {
-		klog.Info("No username specified in secrets")
+	if err := d.volumeLocks.Acquire(volumeId, "NodeStageVolume"); err != nil {
+		return nil, err
 	}
+	defer d.volumeLocks.Release(volumeId)
+
+	sourceMountPoint := mounter.CifsSource(server, share, volumeSubDir(volumeId, volumeContext))
 
-	// Check if  password (optional) is present, else log that no password was provided
-	password, isPasswordPresent := secrets["password"]
-	if !isPasswordPresent {
-		klog.Info("No password specified in secrets")
+	// Ownership which could not be set on the share is applied through the mount
+	ownershipOptions, err := ownershipMountOptions(volumeContext, mountFlags)
+	if err != nil {
+		return nil, err
 	}
 
-	// Append all necessary mount-args to an array
-	var mountOptions []string
-	mountOptions = append(mountOptions, fmt.Sprintf("username=%s", username))
-	mountOptions = append(mountOptions, fmt.Sprintf("password=%s", password))
-	mountOptions = append(mountOptions, fmt.Sprintf("vers=%s", "3.0"))
-	mountOptions = append(mountOptions, mountFlags...)
+	// The security mode is the same as for the share mounts of the controller
+	if err := checkSecurityMode(volumeContext, mountFlags, secrets); err != nil {
+		return nil, err
+	}
+	securityOptions, err := securityMountOptions(volumeContext, mountFlags)
+	if err != nil {
+		return nil, err
+	}
+	smbVersions, err := smbVersionCandidates(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := parseTransportSecurity(volumeContext)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := d.Mounter.Mount(sourceMountPoint, targetPath, mountOptions); err != nil {
-		klog.Infof("Failed: %s", err.Error())
+	// The pod fsGroup, files on the share can't be chowned to it
+	group := request.GetVolumeCapability().GetMount().GetVolumeMountGroup()
+	groupOptions, err := volumeMountGroupOptions(group)
+	if err != nil {
 		return nil, err
 	}
 
+	parameterOptions, err := mounter.MergeMountFlags(securityOptions, ownershipOptions)
+	if err != nil {
+		return nil, err
+	}
+	sealedSecrets, err := d.secretBox.Seal(secrets)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed sealing the secrets: %s", err.Error())
+	}
+
+	staged := &stagedVolume{
+		Source:           sourceMountPoint,
+		StagingPath:      targetPath,
+		SealedSecrets:    sealedSecrets,
+		Username:         secrets["username"],
+		Domain:           secrets["domain"],
+		ParameterOptions: parameterOptions,
+		MountFlags:       mountFlags,
+		SMBVersions:      smbVersions,
+		Transport:        transport,
+		Group:            group,
+		GroupTargets:     make(map[string]map[string]bool),
+		RemountAttempts:  make(map[string]int),
+		RemountTargets:   make(map[string][]mounter.MountInfo),
+	}
+	if !isAutoSMBVersion(volumeContext) {
+		staged.PinnedVersion = smbVersions[0]
+	}
+
+	// The mountOptions of the PV take precedence over the ones of the parameters, the credentials are added by AuthMount
+	mountOptions, err := staged.mountOptions(groupOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// A secret with a principal authenticates with Kerberos instead of username and password
+	krb5Credentials, isKerberos, _ := kerberos.FromSecrets(secrets)
+	if isKerberos {
+		// Logging in again on a staged volume resumes the renewal, e.g. after a restart of the driver
+		credentialCache, err := d.Kerberos.Login(volumeId, *krb5Credentials)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "Failed obtaining Kerberos tickets: %s", err.Error())
+		}
+		staged.CredentialCache = credentialCache
+	}
+
+	// Kubelet retries after a timeout, so the volume may be staged already
+	isStaged, err := d.isMountedFrom(targetPath, sourceMountPoint, staged.comparedOptions(mountOptions))
+	if err != nil {
+		return nil, err
+	}
+	stageEntry := journal.Entry{Kind: journal.KindStage, VolumeID: volumeId, Path: targetPath, Source: sourceMountPoint, Group: group}
+	if isStaged {
+		logging.FromContext(ctx, "node").Info("Volume is already staged", "path", targetPath)
+		d.stagedVolumes.Add(volumeId, staged)
+		d.recordMount(stageEntry)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if err := d.mountStaged(ctx, staged, targetPath, mountOptions); err != nil {
+		if isKerberos { d.Kerberos.Logout(volumeId) }
+		return nil, err
+	}
+	d.stagedVolumes.Add(volumeId, staged)
+	d.recordMount(stageEntry)
+
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
@@ -68,28 +149,79 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, request *csi.NodeUnstage
 		return nil, status.Error(codes.InvalidArgument, "Empty Target Path")
 	}
 
-	// Delete Directory on remote server when unmounting?
+	if err := d.volumeLocks.Acquire(request.GetVolumeId(), "NodeUnstageVolume"); err != nil {
+		return nil, err
+	}
+	defer d.volumeLocks.Release(request.GetVolumeId())
+
+	if err := d.unstageGroups(ctx, targetPath); err != nil {
+		return nil, err
+	}
+
+	if err := d.Mounter.Unmount(ctx, targetPath); err != nil {
+		return nil, err
+	}
 
-	if err := d.Mounter.Unmount(targetPath); err != nil {
+	// Fails if the unmount did not take effect, instead of deleting through the mount
+	if err := d.Mounter.RemoveMountPoint(targetPath); err != nil {
 		return nil, err
 	}
 
-	_ = d.Mounter.DeleteDir(targetPath)
+	// The tickets are only renewed as long as the volume is staged
+	d.Kerberos.Logout(request.GetVolumeId())
+	d.stagedVolumes.Remove(request.GetVolumeId())
+	d.forgetMount(journal.KindStage, targetPath)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (d *Driver) NodePublishVolume(ctx context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 
+	// Ephemeral inline volumes are not staged and get mounted directly
+	if isEphemeral(request.GetVolumeContext()) {
+		return d.publishEphemeralVolume(ctx, request)
+	}
+
 	stagingPath := request.GetStagingTargetPath()
 	targetPath := request.GetTargetPath()
 
 	if stagingPath == "" { return nil, status.Error(codes.InvalidArgument, "No Staging Path Present")}
 	if targetPath == "" { return nil, status.Error(codes.InvalidArgument, "No Staging Path Present")}
 
-	if err := d.Mounter.BindMount(stagingPath, targetPath); err != nil {
+	if err := d.volumeLocks.Acquire(request.GetVolumeId(), "NodePublishVolume"); err != nil {
+		return nil, err
+	}
+	defer d.volumeLocks.Release(request.GetVolumeId())
+
+	// A pod with another fsGroup than the one the volume was staged for gets a stage mount for its group
+	group := request.GetVolumeCapability().GetMount().GetVolumeMountGroup()
+	sourcePath, err := d.stageForGroup(ctx, request.GetVolumeId(), stagingPath, group, targetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pods with readOnly: true and the reader only access modes must not be able to write to the share
+	readOnly := request.GetReadonly() || isReaderOnly(request.GetVolumeCapability())
+
+	isPublished, err := d.isBindMountOf(targetPath, sourcePath, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	publishEntry := journal.Entry{Kind: journal.KindPublish, VolumeID: request.GetVolumeId(), Path: targetPath, StagingPath: sourcePath, ReadOnly: readOnly, Group: group}
+	if isPublished {
+		logging.FromContext(ctx, "node").Info("Volume is already published", "path", targetPath)
+		d.recordMount(publishEntry)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if err := d.Mounter.BindMount(ctx, sourcePath, targetPath, readOnly); err != nil {
+		if releaseErr := d.releaseGroupStage(ctx, request.GetVolumeId(), targetPath); releaseErr != nil {
+			logging.FromContext(ctx, "node").Error(releaseErr, "Releasing stage mount of the volume mount group failed", "path", targetPath)
+		}
 		return nil, err
 	}
+	d.recordMount(publishEntry)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -101,11 +233,29 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, request *csi.NodeUnpub
 		return nil, status.Error(codes.InvalidArgument, "Empty Target Path")
 	}
 
-	if err := d.Mounter.Unmount(targetPath); err != nil {
+	if err := d.volumeLocks.Acquire(request.GetVolumeId(), "NodeUnpublishVolume"); err != nil {
 		return nil, err
 	}
+	defer d.volumeLocks.Release(request.GetVolumeId())
+	d.Usage.Forget(request.GetVolumeId(), targetPath)
 
-	_ = d.Mounter.DeleteDir(targetPath)
+	if volume, isEphemeralVolume := d.ephemeralVolume(request.GetVolumeId(), targetPath); isEphemeralVolume {
+		return d.unpublishEphemeralVolume(ctx, request.GetVolumeId(), targetPath, volume)
+	}
+
+	if err := d.Mounter.Unmount(ctx, targetPath); err != nil {
+		return nil, err
+	}
+
+	if err := d.Mounter.RemoveMountPoint(targetPath); err != nil {
+		return nil, err
+	}
+
+	d.forgetMount(journal.KindPublish, targetPath)
+
+	if err := d.releaseGroupStage(ctx, request.GetVolumeId(), targetPath); err != nil {
+		return nil, err
+	}
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -122,7 +272,12 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, request *csi.NodeGetVol
 
 
 
-	healthy, reason := healtchCheck.HealthCheck(volumePath, pv.Spec.Capacity.Storage().Value())
+	capacity := pv.Spec.Capacity.Storage().Value()
+	// A hard mount of an unreachable server blocks stat and statfs, they are probed with a timeout
+	healthy, reason := d.Probes.HealthCheck(volumePath, capacity)
+	if healthy && d.activeProbeSlowThreshold != nil {
+		healthy, reason = d.Probes.ActiveCheck(volumePath, activeProbeFile(d.NodeID), d.isReadOnlyPublish(volumePath), *d.activeProbeSlowThreshold)
+	}
 	resp := &csi.NodeGetVolumeStatsResponse{
 		VolumeCondition: &csi.VolumeCondition{
 			Abnormal: !healthy,
@@ -130,23 +285,37 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, request *csi.NodeGetVol
 		},
 	}
 
-	available, capacity, usage, inodes, inodesFree, inodesUsed, err := healtchCheck.FsInfo(volumePath)
-	if err == nil {
-		resp.Usage = []*csi.VolumeUsage{
-			{
-				Unit: csi.VolumeUsage_BYTES,
-				Available: available,
-				Total: capacity,
-				Used: usage,
-			},
-			{
-				Unit: csi.VolumeUsage_INODES,
-				Available: inodesFree,
-				Total: inodes,
-				Used: inodesUsed,
-			},
+	// statfs reports the whole share, so the usage of the volume directory is computed by walking it in the background.
+	// Until the first walk finished, no usage is reported.
+	volumeUsage, isUsageKnown := d.Usage.Get(volumeID, volumePath)
+	if !isUsageKnown {
+		logging.FromContext(ctx, "node").V(2).Info("Usage of volume is not computed yet", "path", volumePath)
+		return resp, nil
+	}
+
+	// Without a provisioned capacity, the volume can use the free space of the share
+	if capacity <= 0 {
+		if available, _, _, _, _, _, err := d.Probes.FsInfo(volumePath); err == nil {
+			capacity = volumeUsage.Bytes + available
 		}
 	}
+	available := capacity - volumeUsage.Bytes
+	if available < 0 {
+		available = 0
+	}
+
+	resp.Usage = []*csi.VolumeUsage{
+		{
+			Unit: csi.VolumeUsage_BYTES,
+			Available: available,
+			Total: capacity,
+			Used: volumeUsage.Bytes,
+		},
+		{
+			Unit: csi.VolumeUsage_INODES,
+			Used: volumeUsage.Inodes,
+		},
+	}
 
 	return resp, nil
 
@@ -162,6 +331,8 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, request *csi.NodeGetCa
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 	}
 
 	var capabilityObjects []*csi.NodeServiceCapability
@@ -190,3 +361,69 @@ func (d *Driver) NodeGetInfo(ctx context.Context, request *csi.NodeGetInfoReques
 
 	return resp, nil
 }
+
+// Options which show up unchanged in the mount table and must match for a mount to be identical
+var comparedCifsOptions = []string{"username", "domain", "sec", "vers", "uid", "gid", "dir_mode", "file_mode"}
+
+// isMountedFrom reports if the path is a cifs mount of the source with the same options.
+// A different mount at the path is an AlreadyExists error.
+func (d *Driver) isMountedFrom(path string, source string, mountOptions []string) (bool, error) {
+	existing, err := d.Mounter.GetMount(path)
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "Failed reading mount table: %s", err.Error())
+	}
+	if existing == nil {
+		return false, nil
+	}
+	if existing.FsType != "cifs" || !mounter.SameCifsSource(existing.Source, source) {
+		return false, status.Errorf(codes.AlreadyExists, "%s is already mounted from %s (%s)", path, existing.Source, existing.FsType)
+	}
+	if conflicting := existing.ConflictingOptions(mountOptions, comparedCifsOptions...); len(conflicting) > 0 {
+		return false, status.Errorf(codes.AlreadyExists, "%s is already mounted from %s with different options: %s", path, source, strings.Join(conflicting, ", "))
+	}
+	return true, nil
+}
+
+// activeProbeFile is the hidden file the active probe writes, one per node as a volume may be published on several nodes
+func activeProbeFile(nodeID string) string {
+	return ".csi-health-probe-" + nodeID
+}
+
+// isReadOnlyPublish reports if the volume path is mounted read-only, so the active probe must not write to it
+func (d *Driver) isReadOnlyPublish(volumePath string) bool {
+	mount, err := d.Mounter.GetMount(volumePath)
+	if err != nil || mount == nil {
+		return false
+	}
+	return mount.IsReadOnly()
+}
+
+// isReaderOnly reports if the access mode of the capability does not allow writing
+func isReaderOnly(capability *csi.VolumeCapability) bool {
+	mode := capability.GetAccessMode().GetMode()
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY || mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// isBindMountOf reports if the target is a bind mount of the staging path with the requested read-only state.
+// A different mount at the target is an AlreadyExists error.
+func (d *Driver) isBindMountOf(targetPath string, stagingPath string, readOnly bool) (bool, error) {
+	existing, err := d.Mounter.GetMount(targetPath)
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "Failed reading mount table: %s", err.Error())
+	}
+	if existing == nil {
+		return false, nil
+	}
+	staged, err := d.Mounter.GetMount(stagingPath)
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "Failed reading mount table: %s", err.Error())
+	}
+	// A bind mount shares the filesystem and root with its source
+	if staged == nil || existing.MajorMinor != staged.MajorMinor || existing.Root != staged.Root {
+		return false, status.Errorf(codes.AlreadyExists, "%s is already mounted from %s, which is not the staging path %s", targetPath, existing.Source, stagingPath)
+	}
+	if existing.IsReadOnly() != readOnly {
+		return false, status.Errorf(codes.AlreadyExists, "%s is already published with read-only %t", targetPath, existing.IsReadOnly())
+	}
+	return true, nil
+}
@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// StorageClass parameters applied to the volume directory
+	dirModeKey = "dirMode"
+	uidKey     = "uid"
+	gidKey     = "gid"
+	// Volume context key recording where the ownership has to be applied
+	ownershipKey = "ownership"
+
+	// Ownership and mode got persisted on the share (unix extensions)
+	ownershipShare = "share"
+	// Ownership and mode could not be persisted and are applied through mount options on the node
+	ownershipMount = "mount"
+
+	// Same as the cifs default dir_mode
+	defaultDirMode os.FileMode = 0755
+)
+
+type dirPermissions struct {
+	Mode os.FileMode
+	// -1 if not set
+	UID int
+	GID int
+}
+
+// parseDirPermissions reads dirMode, uid and gid from StorageClass parameters or the volume context
+func parseDirPermissions(parameters map[string]string) (*dirPermissions, error) {
+
+	permissions := &dirPermissions{
+		Mode: defaultDirMode,
+		UID:  -1,
+		GID:  -1,
+	}
+
+	if dirMode, isDirModePresent := parameters[dirModeKey]; isDirModePresent {
+		mode, err := strconv.ParseUint(dirMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid dirMode %s, must be an octal mode like 0775", dirMode)
+		}
+		permissions.Mode = os.FileMode(mode)
+	}
+
+	if uid, isUIDPresent := parameters[uidKey]; isUIDPresent {
+		id, err := strconv.ParseUint(uid, 10, 31)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid uid %s", uid)
+		}
+		permissions.UID = int(id)
+	}
+
+	if gid, isGIDPresent := parameters[gidKey]; isGIDPresent {
+		id, err := strconv.ParseUint(gid, 10, 31)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid gid %s", gid)
+		}
+		permissions.GID = int(id)
+	}
+
+	return permissions, nil
+}
+
+// applyDirPermissions sets mode and ownership on a freshly created volume directory.
+// Without unix extensions the server silently ignores both, which is detected by
+// reading them back. The returned value is stored in the volume context under ownershipKey.
+func (d *Driver) applyDirPermissions(localVolumePath string, permissions *dirPermissions) string {
+
+	if err := d.Mounter.SetPermissions(localVolumePath, permissions.Mode, permissions.UID, permissions.GID); err != nil {
+		return ownershipMount
+	}
+
+	mode, uid, gid, err := d.Mounter.GetPermissions(localVolumePath)
+	if err != nil {
+		return ownershipMount
+	}
+	if mode != permissions.Mode ||
+		(permissions.UID >= 0 && uid != permissions.UID) ||
+		(permissions.GID >= 0 && gid != permissions.GID) {
+		return ownershipMount
+	}
+
+	return ownershipShare
+}
+
+// ownershipMountOptions returns the mount options for volumes whose ownership could not be set on the share.
+// Options already given by the user are not overridden.
+func ownershipMountOptions(volumeContext map[string]string, mountFlags []string) ([]string, error) {
+
+	if volumeContext[ownershipKey] != ownershipMount {
+		return nil, nil
+	}
+
+	permissions, err := parseDirPermissions(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	isFlagPresent := func(name string) bool {
+		for _, flag := range mountFlags {
+			if flag == name || strings.HasPrefix(flag, name+"=") {
+				return true
+			}
+		}
+		return false
+	}
+
+	var mountOptions []string
+	if !isFlagPresent("dir_mode") {
+		mountOptions = append(mountOptions, fmt.Sprintf("dir_mode=%04o", permissions.Mode))
+	}
+	if permissions.UID >= 0 && !isFlagPresent("uid") {
+		mountOptions = append(mountOptions, fmt.Sprintf("uid=%d", permissions.UID), "forceuid")
+	}
+	if permissions.GID >= 0 && !isFlagPresent("gid") {
+		mountOptions = append(mountOptions, fmt.Sprintf("gid=%d", permissions.GID), "forcegid")
+	}
+
+	return mountOptions, nil
+}
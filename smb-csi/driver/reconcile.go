@@ -0,0 +1,216 @@
+package driver
+
+import (
+	"context"
+	"smb-csi/driver/journal"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/mounter"
+	"smb-csi/driver/tracing"
+)
+
+// Outcomes of reconciling a journal entry with the mount table
+const (
+	reconcileKept    = "kept"
+	reconcileRebound = "bound again"
+	reconcileCleaned = "cleaned up"
+	reconcileBroken  = "broken"
+	reconcileForeign = "replaced by foreign mounts"
+)
+
+// openJournal opens the node journal, reconciles it with the mount table and resumes the Kerberos renewal of the
+// journaled stage mounts. Mounts of the node plugin before a restart are only known from the journal,
+// the controller has no mounts to journal.
+func (d *Driver) openJournal(config Config) error {
+	if config.Mode != nodeMode || config.JournalPath == "" {
+		return nil
+	}
+	nodeJournal, err := journal.Open(config.JournalPath)
+	if err != nil {
+		return err
+	}
+	d.Journal = nodeJournal
+	d.reconcileJournal()
+	d.resumeKerberos()
+	return nil
+}
+
+// recordMount adds the mount to the journal. The journal only serves the reconciliation after a restart,
+// so an operation does not fail because it could not be recorded.
+func (d *Driver) recordMount(entry journal.Entry) {
+	if d.Journal == nil {
+		return
+	}
+	if err := d.Journal.Record(entry); err != nil {
+		logging.For("journal").Error(err, "Recording mount in the node journal failed", "kind", entry.Kind, "path", entry.Path, logging.VolumeIDKey, entry.VolumeID)
+	}
+}
+
+func (d *Driver) forgetMount(kind string, path string) {
+	if d.Journal == nil {
+		return
+	}
+	if err := d.Journal.Remove(kind, path); err != nil {
+		logging.For("journal").Error(err, "Removing mount from the node journal failed", "kind", kind, "path", path)
+	}
+}
+
+// reconcileJournal compares the mounts of the journal with the mount table after a restart of the node plugin or the node.
+// Stage mounts which are gone are cleaned up, as kubelet stages the volume again if a pod still uses it.
+// Publish mounts whose stage mount is still working are bound again. Mounts which are not in the journal are never touched.
+func (d *Driver) reconcileJournal() {
+	if d.Journal == nil {
+		return
+	}
+
+	ctx, span := tracing.Start(context.Background(), "reconcile node journal")
+	defer span.End()
+	ctx = logging.WithFields(ctx, logging.CorrelationIDKey, logging.NewCorrelationID(), logging.NodeIDKey, d.NodeID)
+	log := logging.FromContext(ctx, "journal")
+
+	outcomes := make(map[string]int)
+	for _, entry := range d.Journal.Entries() {
+		var outcome string
+		entryCtx := logging.WithFields(ctx, logging.VolumeIDKey, entry.VolumeID)
+		switch entry.Kind {
+		case journal.KindStage:
+			outcome = d.reconcileStage(entryCtx, entry)
+		case journal.KindPublish:
+			outcome = d.reconcilePublish(entryCtx, entry)
+		case journal.KindEphemeral:
+			outcome = d.reconcileEphemeral(entryCtx, entry)
+		default:
+			log.Info("Dropping unknown entry from the node journal", "kind", entry.Kind, "path", entry.Path)
+			d.forgetMount(entry.Kind, entry.Path)
+			continue
+		}
+		logging.FromContext(entryCtx, "journal").Info("Reconciled mount", "kind", entry.Kind, "path", entry.Path, "outcome", outcome)
+		outcomes[outcome]++
+	}
+
+	log.Info("Reconciled node journal", "kept", outcomes[reconcileKept], "boundAgain", outcomes[reconcileRebound], "cleanedUp", outcomes[reconcileCleaned],
+		"broken", outcomes[reconcileBroken], "foreign", outcomes[reconcileForeign])
+}
+
+func (d *Driver) reconcileStage(ctx context.Context, entry journal.Entry) string {
+	log := logging.FromContext(ctx, "journal")
+	existing, err := d.Mounter.GetMount(entry.Path)
+	if err != nil {
+		log.Error(err, "Reading mount table failed")
+		return reconcileKept
+	}
+
+	if existing == nil {
+		// The node was rebooted or the volume was unmounted by someone else
+		if err := d.unstageGroups(ctx, entry.Path); err != nil {
+			log.Error(err, "Unstaging volume mount groups failed", "path", entry.Path)
+		}
+		if err := d.Mounter.RemoveMountPoint(entry.Path); err != nil {
+			log.Error(err, "Removing mount point failed", "path", entry.Path)
+			return reconcileKept
+		}
+		d.forgetMount(journal.KindStage, entry.Path)
+		return reconcileCleaned
+	}
+
+	if existing.FsType != "cifs" || !mounter.SameCifsSource(existing.Source, entry.Source) {
+		d.forgetMount(journal.KindStage, entry.Path)
+		return reconcileForeign
+	}
+
+	// The secrets are not known after a restart, so a broken stage mount can only be removed once nothing uses it
+	if brokenErr := d.checkStageMount(entry.Path); brokenErr != nil {
+		if d.isPublishedFrom(entry.Path) {
+			log.Info("Stage mount is broken and still published, the volume has to be staged again", "path", entry.Path, "err", brokenErr)
+			return reconcileBroken
+		}
+		if err := d.unstageGroups(ctx, entry.Path); err != nil {
+			log.Error(err, "Unstaging volume mount groups failed", "path", entry.Path)
+			return reconcileBroken
+		}
+		if err := d.Mounter.DetachMount(ctx, entry.Path); err != nil {
+			log.Error(err, "Detaching broken stage mount failed", "path", entry.Path)
+			return reconcileBroken
+		}
+		if err := d.Mounter.RemoveMountPoint(entry.Path); err != nil {
+			log.Error(err, "Removing mount point failed", "path", entry.Path)
+		}
+		d.forgetMount(journal.KindStage, entry.Path)
+		return reconcileCleaned
+	}
+	return reconcileKept
+}
+
+func (d *Driver) reconcilePublish(ctx context.Context, entry journal.Entry) string {
+	log := logging.FromContext(ctx, "journal")
+	isBound, err := d.isBindMountOf(entry.Path, entry.StagingPath, entry.ReadOnly)
+	if err != nil {
+		d.forgetMount(journal.KindPublish, entry.Path)
+		return reconcileForeign
+	}
+	if isBound {
+		return reconcileKept
+	}
+
+	if d.checkStageMount(entry.StagingPath) == nil {
+		if err := d.Mounter.BindMount(ctx, entry.StagingPath, entry.Path, entry.ReadOnly); err != nil {
+			log.Error(err, "Binding publish mount again failed", "path", entry.Path, "stagingPath", entry.StagingPath)
+			return reconcileBroken
+		}
+		return reconcileRebound
+	}
+
+	// Kubelet publishes the volume again once it is staged again
+	if err := d.Mounter.RemoveMountPoint(entry.Path); err != nil {
+		log.Error(err, "Removing mount point failed", "path", entry.Path)
+		return reconcileKept
+	}
+	d.forgetMount(journal.KindPublish, entry.Path)
+	return reconcileCleaned
+}
+
+// reconcileEphemeral removes the scratch directory of an ephemeral volume whose mount is gone.
+// Kubelet unpublishes ephemeral volumes which are still mounted, with the share mount kept for them.
+func (d *Driver) reconcileEphemeral(ctx context.Context, entry journal.Entry) string {
+	log := logging.FromContext(ctx, "journal")
+	isPublished, err := d.isMountedFrom(entry.Path, mounter.CifsSource(entry.Source, entry.VolumeID), nil)
+	if err != nil {
+		d.forgetMount(journal.KindEphemeral, entry.Path)
+		return reconcileForeign
+	}
+	if isPublished {
+		return reconcileKept
+	}
+
+	if err := d.removeScratchDir(ctx, entry.VolumeID, &ephemeralVolume{Source: entry.Source, SharePath: entry.StagingPath}); err != nil {
+		log.Error(err, "Removing scratch directory of ephemeral volume failed", "path", entry.StagingPath)
+		return reconcileBroken
+	}
+	if err := d.Mounter.RemoveMountPoint(entry.Path); err != nil {
+		log.Error(err, "Removing mount point failed", "path", entry.Path)
+		return reconcileKept
+	}
+	d.forgetMount(journal.KindEphemeral, entry.Path)
+	return reconcileCleaned
+}
+
+// resumeKerberos renews the Kerberos tickets of the volumes which are still staged after a restart
+func (d *Driver) resumeKerberos() {
+	for _, entry := range d.Journal.Entries() {
+		if entry.Kind == journal.KindStage && d.Kerberos.Resume(entry.VolumeID) {
+			logging.For("journal").Info("Renewing Kerberos tickets of staged volume again", logging.VolumeIDKey, entry.VolumeID)
+		}
+	}
+}
+
+// isPublishedFrom reports if the journal has a publish mount bound from the staging path or one of its volume mount groups
+func (d *Driver) isPublishedFrom(stagingPath string) bool {
+	for _, entry := range d.Journal.Entries() {
+		if entry.Kind != journal.KindPublish {
+			continue
+		}
+		if entry.StagingPath == stagingPath || (entry.Group != "" && entry.StagingPath == groupStagingPath(stagingPath, entry.Group)) {
+			return true
+		}
+	}
+	return false
+}
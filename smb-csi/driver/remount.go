@@ -0,0 +1,178 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/mounter"
+	"smb-csi/driver/tracing"
+	"syscall"
+	"time"
+)
+
+// Errors of a cifs mount whose session is gone for good, e.g. after the SMB server was restarted
+var brokenMountErrors = []error{
+	syscall.ESTALE, syscall.EHOSTDOWN, syscall.ENOTCONN, syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EIO, syscall.EKEYEXPIRED,
+}
+
+var errNotMounted = errors.New("not mounted")
+
+func isBrokenMountError(err error) bool {
+	for _, broken := range brokenMountErrors {
+		if errors.Is(err, broken) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchStageMounts checks the stage mounts of the staged volumes in the interval and mounts broken ones again
+func (d *Driver) watchStageMounts(interval time.Duration, maxAttempts int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopWatch:
+			return
+		case <-ticker.C:
+			for volumeID := range d.stagedVolumes.List() {
+				// A volume with an operation in progress is checked next time
+				if err := d.volumeLocks.Acquire(volumeID, "RemountStageMount"); err != nil {
+					continue
+				}
+				// The volume may have been unstaged meanwhile
+				if staged, isStaged := d.stagedVolumes.Get(volumeID); isStaged {
+					d.healStagedVolume(volumeID, staged, maxAttempts)
+				}
+				d.volumeLocks.Release(volumeID)
+			}
+		}
+	}
+}
+
+// healStagedVolume mounts the broken stage mounts of the volume again, the one at the staging path
+// and those of other volume mount groups, giving up after the max attempts until a mount works again
+func (d *Driver) healStagedVolume(volumeID string, staged *stagedVolume, maxAttempts int) {
+
+	stageMounts := map[string]string{staged.StagingPath: staged.Group}
+	for group := range staged.GroupTargets {
+		stageMounts[groupStagingPath(staged.StagingPath, group)] = group
+	}
+
+	for path, group := range stageMounts {
+		brokenErr := d.checkStageMount(path)
+		if brokenErr == nil {
+			delete(staged.RemountAttempts, path)
+			continue
+		}
+
+		attempts := staged.RemountAttempts[path]
+		if attempts > maxAttempts {
+			continue
+		}
+		staged.RemountAttempts[path]++
+		if attempts == maxAttempts {
+			d.recordVolumeEvent(volumeID, corev1.EventTypeWarning, "RemountGaveUp", "Stage mount %s is broken (%s), giving up after %d attempts to mount it again", path, brokenErr.Error(), maxAttempts)
+			continue
+		}
+
+		// The remount is traced on its own, as there is no request it belongs to
+		ctx, span := tracing.Start(context.Background(), "remount stage mount", attribute.String("volumeID", volumeID), attribute.String("path", path))
+		ctx = logging.WithFields(ctx, logging.CorrelationIDKey, logging.NewCorrelationID(), logging.VolumeIDKey, volumeID, logging.NodeIDKey, d.NodeID)
+		err := d.remountStaged(ctx, staged, path, group)
+		tracing.End(span, err)
+		if err != nil {
+			d.recordVolumeEvent(volumeID, corev1.EventTypeWarning, "RemountFailed", "Failed mounting broken stage mount %s again, attempt %d of %d: %s", path, attempts+1, maxAttempts, err.Error())
+			continue
+		}
+		delete(staged.RemountAttempts, path)
+		d.recordVolumeEvent(volumeID, corev1.EventTypeNormal, "Remounted", "Mounted broken stage mount %s again after %s", path, brokenErr.Error())
+	}
+}
+
+// checkStageMount returns the error of a stage mount which is broken, or nil.
+// The directory is listed, as the attributes of a stat may come from the cache of the cifs module.
+func (d *Driver) checkStageMount(path string) error {
+	isMounted, err := d.Mounter.IsMountPoint(path)
+	if err != nil {
+		return nil
+	}
+	// A stage mount which was detached by a failed remount
+	if !isMounted {
+		return errNotMounted
+	}
+	_, err = d.Probes.Run("list", path, func() (interface{}, error) {
+		dir, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+		_, err = dir.Readdirnames(1)
+		return nil, err
+	})
+	if isBrokenMountError(err) {
+		return err
+	}
+	return nil
+}
+
+// remountStaged replaces the broken stage mount with a new mount of the share and binds the published targets to it again.
+// The broken mount is detached, as unmounting it may fail or hang while the published targets use it.
+func (d *Driver) remountStaged(ctx context.Context, staged *stagedVolume, path string, group string) error {
+
+	groupOptions, err := volumeMountGroupOptions(group)
+	if err != nil {
+		return err
+	}
+	// The kernel must not reuse the session of the broken mount
+	stagedOptions, err := staged.mountOptions(groupOptions)
+	if err != nil {
+		return err
+	}
+	mountOptions, err := mounter.MergeMountFlags(stagedOptions, []string{"nosharesock"})
+	if err != nil {
+		return err
+	}
+
+	// The published targets are remembered until they are bound again, in case mounting the share fails
+	bindMounts, isRemembered := staged.RemountTargets[path]
+	if !isRemembered {
+		if bindMounts, err = d.Mounter.GetBindMounts(path); err != nil {
+			return err
+		}
+		staged.RemountTargets[path] = bindMounts
+	}
+
+	logging.FromContext(ctx, "remount").Info("Mounting broken stage mount again", "path", path, "source", staged.Source)
+	if err := d.Mounter.DetachMount(ctx, path); err != nil {
+		return err
+	}
+	if err := d.mountStaged(ctx, staged, path, mountOptions); err != nil {
+		return err
+	}
+
+	// Containers only see the new mount at their target with HostToContainer mount propagation, others have to be restarted
+	for _, bindMount := range bindMounts {
+		if err := d.Mounter.DetachMount(ctx, bindMount.MountPoint); err != nil {
+			return err
+		}
+		if err := d.Mounter.BindMount(ctx, path, bindMount.MountPoint, bindMount.IsReadOnly()); err != nil {
+			return err
+		}
+	}
+	delete(staged.RemountTargets, path)
+	return nil
+}
+
+// recordVolumeEvent emits an event on the PV of the volume, if the driver has an event recorder
+func (d *Driver) recordVolumeEvent(volumeID string, eventType string, reason string, messageFmt string, args ...interface{}) {
+	logging.For("remount").Info(fmt.Sprintf(messageFmt, args...), logging.VolumeIDKey, volumeID, "reason", reason)
+	if d.Events == nil {
+		return
+	}
+	d.Events.Eventf(&corev1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: volumeID}, eventType, reason, messageFmt, args...)
+}
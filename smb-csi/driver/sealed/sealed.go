@@ -0,0 +1,62 @@
+package sealed
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Box encrypts secrets kept in memory with AES-256-GCM, so they don't show up in plain text in a memory dump.
+// The key is random and only lives in the process, secrets sealed by another process can't be opened.
+type Box struct {
+	aead cipher.AEAD
+}
+
+func NewBox() (*Box, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Seal encrypts the secrets, the random nonce is prepended to the result
+func (b *Box) Seal(secrets map[string]string) ([]byte, error) {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Open decrypts secrets sealed by the box
+func (b *Box) Open(sealed []byte) (map[string]string, error) {
+	if len(sealed) < b.aead.NonceSize() {
+		return nil, errors.New("sealed secrets are too short")
+	}
+	nonce, cipherText := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	plain, err := b.aead.Open(nil, nonce, cipherText, nil)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]string)
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
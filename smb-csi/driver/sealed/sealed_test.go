@@ -0,0 +1,31 @@
+package sealed
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBox_OpensSealedSecrets(t *testing.T) {
+	box, err := NewBox()
+	assert.NoError(t, err)
+	secrets := map[string]string{"username": "user", "password": "secret"}
+
+	sealedSecrets, err := box.Seal(secrets)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(sealedSecrets), "secret")
+
+	opened, err := box.Open(sealedSecrets)
+	assert.NoError(t, err)
+	assert.Equal(t, secrets, opened)
+}
+
+func TestBox_RejectsOtherKey(t *testing.T) {
+	box, _ := NewBox()
+	otherBox, _ := NewBox()
+	sealedSecrets, err := box.Seal(map[string]string{"password": "secret"})
+	assert.NoError(t, err)
+
+	opened, err := otherBox.Open(sealedSecrets)
+	assert.Error(t, err)
+	assert.Nil(t, opened)
+}
@@ -0,0 +1,177 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"smb-csi/driver/dfs"
+	"smb-csi/driver/kerberos"
+	"smb-csi/driver/mounter"
+	"strconv"
+	"strings"
+)
+
+const (
+	// StorageClass parameter selecting the cifs security mode
+	secKey = "sec"
+	// Security mode authenticating with the tickets of a Kerberos principal
+	secKerberos = "krb5"
+
+	// StorageClass parameters requiring an encrypted (seal) or signed (sign) SMB3 session
+	requireEncryptionKey = "requireEncryption"
+	requireSigningKey    = "requireSigning"
+)
+
+// transportSecurity is what the SMB session of a volume has to guarantee
+type transportSecurity struct {
+	Encryption bool
+	Signing    bool
+}
+
+// parseTransportSecurity reads requireEncryption and requireSigning from StorageClass parameters or the volume context
+func parseTransportSecurity(parameters map[string]string) (*transportSecurity, error) {
+	security := &transportSecurity{}
+	for key, required := range map[string]*bool{requireEncryptionKey: &security.Encryption, requireSigningKey: &security.Signing} {
+		value, isValuePresent := parameters[key]
+		if !isValuePresent || value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s %s, must be true or false", key, value)
+		}
+		*required = parsed
+	}
+	return security, nil
+}
+
+// mountOptions are the cifs options enforcing the transport security
+func (s *transportSecurity) mountOptions() []string {
+	var options []string
+	if s.Encryption {
+		options = append(options, "seal")
+	}
+	if s.Signing {
+		options = append(options, "sign")
+	}
+	return options
+}
+
+// verifyTransportSecurity checks that the session of the mounted source really negotiated encryption and signing,
+// as servers may accept the mount without them
+func (d *Driver) verifyTransportSecurity(source string, required *transportSecurity) error {
+	if !required.Encryption && !required.Signing {
+		return nil
+	}
+	// The session of a DFS path is the one to the target the kernel resolved it to
+	if referrals, err := dfs.ListReferrals(); err == nil {
+		if target, isResolved := dfs.Resolve(referrals, source); isResolved {
+			source = target
+		}
+	}
+	session, err := d.Mounter.GetSessionSecurity(source)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed verifying the session security of %s: %s", source, err.Error())
+	}
+	if required.Encryption && !session.Encrypted {
+		return status.Errorf(codes.FailedPrecondition, "The session of %s is not encrypted, but requireEncryption is set", source)
+	}
+	if required.Signing && !session.Signed && !session.Encrypted {
+		return status.Errorf(codes.FailedPrecondition, "The session of %s is not signed, but requireSigning is set", source)
+	}
+	return nil
+}
+
+// Security modes of mount.cifs which may be requested, the signing variants (e.g. ntlmsspi) are left out
+var allowedSecurityModes = []string{"ntlmssp", "ntlmv2", secKerberos, "none"}
+
+// securityMode returns the validated sec parameter of the StorageClass or volume context, empty if not set
+func securityMode(parameters map[string]string) (string, error) {
+	mode, isModePresent := parameters[secKey]
+	if !isModePresent || mode == "" {
+		return "", nil
+	}
+	mode = strings.ToLower(mode)
+	for _, allowed := range allowedSecurityModes {
+		if mode == allowed {
+			return mode, nil
+		}
+	}
+	return "", status.Errorf(codes.InvalidArgument, "Invalid sec %s, must be one of %s", mode, strings.Join(allowedSecurityModes, ", "))
+}
+
+// mountSecurityMode returns the security mode a volume is mounted with, a sec in the mount flags takes precedence over the sec parameter
+func mountSecurityMode(parameters map[string]string, mountFlags []string) (string, error) {
+	options, err := mounter.ParseMountOptions(mountFlags)
+	if err != nil {
+		return "", err
+	}
+	if sec, isSecPresent := options.Get(secKey); isSecPresent {
+		return securityMode(map[string]string{secKey: sec.Value})
+	}
+	return securityMode(parameters)
+}
+
+// checkSecurityMode rejects secrets which don't fit the security mode of the sec parameter or mount flags:
+// a secret with a Kerberos principal can only be used with krb5 and krb5 needs a principal.
+func checkSecurityMode(parameters map[string]string, mountFlags []string, secrets map[string]string) error {
+	mode, err := mountSecurityMode(parameters, mountFlags)
+	if err != nil {
+		return err
+	}
+	_, isKerberos, err := kerberos.FromSecrets(secrets)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid Kerberos secret: %s", err.Error())
+	}
+	if isKerberos && mode != "" && mode != secKerberos {
+		return status.Errorf(codes.InvalidArgument, "Secret with a Kerberos principal can't be used with sec %s", mode)
+	}
+	if !isKerberos && mode == secKerberos {
+		return status.Errorf(codes.InvalidArgument, "sec %s needs a principal in the secret", secKerberos)
+	}
+	return nil
+}
+
+// checkCapabilitiesSecurityMode checks the secret against the sec parameter, which the share mounts of the controller use,
+// and against the sec in the mount flags of every requested capability, which the nodes mount the volume with
+func checkCapabilitiesSecurityMode(parameters map[string]string, capabilities []*csi.VolumeCapability, secrets map[string]string) error {
+	if err := checkSecurityMode(parameters, nil, secrets); err != nil {
+		return err
+	}
+	for _, capability := range capabilities {
+		if err := checkSecurityMode(parameters, capability.GetMount().GetMountFlags(), secrets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// securityMountOptions returns the mount options of the sec, requireEncryption and requireSigning parameters.
+// A sec in the mount flags takes precedence.
+func securityMountOptions(parameters map[string]string, mountFlags []string) ([]string, error) {
+	transport, err := parseTransportSecurity(parameters)
+	if err != nil {
+		return nil, err
+	}
+	options := transport.mountOptions()
+
+	mode, err := securityMode(parameters)
+	if err != nil || mode == "" {
+		return options, err
+	}
+	flagOptions, err := mounter.ParseMountOptions(mountFlags)
+	if err != nil || flagOptions.Has(secKey) {
+		return options, err
+	}
+	return append([]string{fmt.Sprintf("%s=%s", secKey, mode)}, options...), nil
+}
+
+// shareMountFlags are the mount flags for a share mount of the controller of a volume with the given context
+func shareMountFlags(volumeContext map[string]string, mountFlags []string) ([]string, error) {
+	securityOptions, err := securityMountOptions(volumeContext, mountFlags)
+	if err != nil {
+		return nil, err
+	}
+	return mounter.MergeMountFlags(securityOptions, mountFlags)
+}
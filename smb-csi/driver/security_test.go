@@ -0,0 +1,21 @@
+package driver
+
+import (
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestCheckSecurityMode_SecMountOptionTakesPrecedence(t *testing.T) {
+	passwordSecrets := map[string]string{"username": "user", "password": "password"}
+	kerberosSecrets := map[string]string{"principal": "user@EXAMPLE.COM", "password": "password"}
+
+	err := checkSecurityMode(nil, []string{"sec=krb5"}, passwordSecrets)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	err = checkSecurityMode(map[string]string{secKey: secKerberos}, []string{"sec=ntlmssp"}, kerberosSecrets)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	assert.NoError(t, checkSecurityMode(map[string]string{secKey: "ntlmssp"}, []string{"sec=krb5"}, kerberosSecrets))
+	assert.NoError(t, checkSecurityMode(map[string]string{secKey: secKerberos}, []string{"ro"}, kerberosSecrets))
+}
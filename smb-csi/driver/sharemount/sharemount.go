@@ -0,0 +1,276 @@
+package sharemount
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"smb-csi/driver/healtchCheck"
+	"smb-csi/driver/kerberos"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/mounter"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manager keeps one mount per share and credential set for the controller.
+// Mounts are reference counted and unmounted once they were idle for the idle timeout,
+// so concurrent operations on the same share don't unmount it under each other.
+type Manager struct {
+	mounter     mounter.Mounter
+	kerberos    *kerberos.Manager
+	probes      *healtchCheck.Prober
+	baseDir     string
+	idleTimeout time.Duration
+	// Key of the HMAC identifying the mounts, the secrets they were mounted with must not be derivable from it
+	keySecret []byte
+
+	mutex  sync.Mutex
+	mounts map[string]*shareMount
+	stop   chan struct{}
+}
+
+type shareMount struct {
+	// Held while mounting, so concurrent borrowers wait for the first one
+	mutex   sync.Mutex
+	key     string
+	source  string
+	path    string
+	mounted bool
+	// The mount stopped working and got replaced, it is unmounted once its last borrower released it
+	broken   bool
+	refs     int
+	lastUsed time.Time
+}
+
+func NewManager(m mounter.Mounter, krb5 *kerberos.Manager, probes *healtchCheck.Prober, baseDir string, idleTimeout time.Duration) (*Manager, error) {
+	keySecret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, keySecret); err != nil {
+		return nil, err
+	}
+	manager := &Manager{
+		mounter:     m,
+		kerberos:    krb5,
+		probes:      probes,
+		baseDir:     baseDir,
+		idleTimeout: idleTimeout,
+		keySecret:   keySecret,
+		mounts:      make(map[string]*shareMount),
+		stop:        make(chan struct{}),
+	}
+	go manager.expireIdleMounts()
+	return manager, nil
+}
+
+// Acquire returns the local path of the cifs source, like //server/share, mounted with the given secrets and mount flags.
+// The returned release function must be called once the path is not used anymore.
+func (m *Manager) Acquire(ctx context.Context, source string, secrets map[string]string, mountFlags []string) (string, func(), error) {
+
+	key := m.mountKey(source, secrets, mountFlags)
+	log := logging.FromContext(ctx, "sharemount").WithValues("source", source)
+
+	for {
+		mount, err := m.borrow(key, source)
+		if err != nil {
+			return "", nil, err
+		}
+		mount.mutex.Lock()
+
+		// A mount whose server went away is replaced by a new one, the borrowers of the broken mount keep it until they release it
+		if mount.mounted && m.isBroken(mount.path) {
+			mount.mutex.Unlock()
+			log.Info("Share mount is broken, mounting the share again", "path", mount.path)
+			m.retire(mount)
+			m.release(mount)
+			continue
+		}
+
+		if !mount.mounted {
+			if err := m.mount(ctx, mount, secrets, mountFlags); err != nil {
+				// The mount point is random, nobody would ever remove it again
+				if removeErr := m.mounter.RemoveMountPoint(mount.path); removeErr != nil {
+					log.Error(removeErr, "Removing mount point of failed mount failed", "path", mount.path)
+				}
+				mount.mutex.Unlock()
+				m.release(mount)
+				return "", nil, err
+			}
+			mount.mounted = true
+		}
+		mount.mutex.Unlock()
+
+		var once sync.Once
+		return mount.path, func() { once.Do(func() { m.release(mount) }) }, nil
+	}
+}
+
+// borrow returns the mount of the key with a reference for the caller, creating it if there is none
+func (m *Manager) borrow(key string, source string) (*shareMount, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mount, isMountPresent := m.mounts[key]
+	if !isMountPresent {
+		// The mount point is world-listable, so it is named after the share and a random ID
+		id := make([]byte, 6)
+		if _, err := io.ReadFull(rand.Reader, id); err != nil {
+			return nil, err
+		}
+		// A DFS path may have more than one component
+		share := strings.SplitN(strings.TrimPrefix(source, "//"), "/", 2)
+		mount = &shareMount{
+			key:    key,
+			source: source,
+			path:   filepath.Join(m.baseDir, strings.Replace(share[len(share)-1], "/", "_", -1)+"-"+hex.EncodeToString(id)),
+		}
+		m.mounts[key] = mount
+	}
+	mount.refs++
+	return mount, nil
+}
+
+// isBroken stats the mount point through the prober, as a stat of a hard mount of an unreachable server never returns
+func (m *Manager) isBroken(path string) bool {
+	_, err := m.probes.Run("stat", path, func() (interface{}, error) {
+		return os.Stat(path)
+	})
+	switch err.(type) {
+	case *healtchCheck.ProbeTimeoutError, *os.PathError:
+		return true
+	default:
+		return false
+	}
+}
+
+// retire replaces the broken mount, so the next borrower mounts the share again
+func (m *Manager) retire(mount *shareMount) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mount.broken = true
+	if m.mounts[mount.key] == mount {
+		delete(m.mounts, mount.key)
+	}
+}
+
+// mount mounts the share with username and password or, for a secret with a principal, with Kerberos
+func (m *Manager) mount(ctx context.Context, mount *shareMount, secrets map[string]string, mountFlags []string) error {
+	credentials, isKerberos, err := kerberos.FromSecrets(secrets)
+	if err != nil {
+		return err
+	}
+	if !isKerberos {
+		return m.mounter.AuthMount(ctx, mount.source, mount.path, secrets, mountFlags)
+	}
+
+	credentialCache, err := m.kerberos.Login(mount.key, *credentials)
+	if err != nil {
+		return err
+	}
+	if err := m.mounter.KerberosMount(ctx, mount.source, mount.path, credentialCache, mountFlags); err != nil {
+		m.kerberos.Logout(mount.key)
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) release(mount *shareMount) {
+	m.mutex.Lock()
+	mount.refs--
+	mount.lastUsed = time.Now()
+	isBrokenAndUnused := mount.broken && mount.refs == 0
+	m.mutex.Unlock()
+
+	if isBrokenAndUnused {
+		m.remove(mount)
+	}
+}
+
+// remove detaches a mount which is not in the map anymore. It is detached lazily,
+// as unmounting may hang while its server is unreachable and nobody borrows the mount anymore.
+func (m *Manager) remove(mount *shareMount) {
+	log := logging.For("sharemount").WithValues("source", mount.source, "path", mount.path)
+	if err := m.mounter.DetachMount(context.Background(), mount.path); err != nil {
+		log.Error(err, "Detaching share mount failed")
+		return
+	}
+	if err := m.mounter.RemoveMountPoint(mount.path); err != nil {
+		log.Error(err, "Removing mount point failed")
+	}
+
+	// The share may have been mounted again with the same key, whose Kerberos session must be kept.
+	// A new mount logs in only after it got into the map, so checking under the lock is enough.
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.mounts[mount.key] == nil {
+		m.kerberos.Logout(mount.key)
+	}
+}
+
+func (m *Manager) expireIdleMounts() {
+	ticker := time.NewTicker(m.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.unmountIdle(time.Now().Add(-m.idleTimeout))
+		}
+	}
+}
+
+// unmountIdle unmounts all unused mounts last used before the given time.
+// They are taken out of the map under the lock, so they can't be borrowed again,
+// and unmounted without it, so a hanging server does not block the other shares.
+func (m *Manager) unmountIdle(before time.Time) {
+	m.mutex.Lock()
+	var idle []*shareMount
+	for key, mount := range m.mounts {
+		if mount.refs > 0 || mount.lastUsed.After(before) {
+			continue
+		}
+		delete(m.mounts, key)
+		if mount.mounted {
+			idle = append(idle, mount)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, mount := range idle {
+		logging.For("sharemount").Info("Unmounting idle share", "source", mount.source, "path", mount.path)
+		m.remove(mount)
+	}
+}
+
+// Stop unmounts all shares which are not in use
+func (m *Manager) Stop() {
+	close(m.stop)
+	m.unmountIdle(time.Now())
+}
+
+// mountKey identifies a share mount by its source and everything that went into mounting it
+func (m *Manager) mountKey(source string, secrets map[string]string, mountFlags []string) string {
+	var keys []string
+	for key := range secrets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := hmac.New(sha256.New, m.keySecret)
+	hash.Write([]byte(source))
+	for _, key := range keys {
+		hash.Write([]byte{0})
+		hash.Write([]byte(key + "=" + secrets[key]))
+	}
+	for _, flag := range mountFlags {
+		hash.Write([]byte{0})
+		hash.Write([]byte(flag))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
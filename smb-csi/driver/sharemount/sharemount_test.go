@@ -0,0 +1,154 @@
+package sharemount
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"smb-csi/driver/healtchCheck"
+	"smb-csi/driver/kerberos"
+	"smb-csi/driver/mounter"
+	"testing"
+	"time"
+)
+
+// fakeMounter mounts by creating the mount point, a mount is broken once its mount point is gone
+type fakeMounter struct {
+	mounter.Mounter
+	detached []string
+	// Mounting fails after the mount point got created
+	mountErr error
+	// Detaching signals detaching and waits for detachBlock, if set
+	detaching   chan struct{}
+	detachBlock chan struct{}
+}
+
+func (f *fakeMounter) AuthMount(ctx context.Context, source string, targetPath string, secrets map[string]string, mountFlags []string) error {
+	if err := os.MkdirAll(targetPath, 0750); err != nil {
+		return err
+	}
+	return f.mountErr
+}
+
+func (f *fakeMounter) Unmount(ctx context.Context, target string) error {
+	return nil
+}
+
+func (f *fakeMounter) DetachMount(ctx context.Context, target string) error {
+	if f.detachBlock != nil {
+		f.detaching <- struct{}{}
+		<-f.detachBlock
+	}
+	f.detached = append(f.detached, target)
+	return nil
+}
+
+func (f *fakeMounter) RemoveMountPoint(path string) error {
+	return os.RemoveAll(path)
+}
+
+func newTestManager(t *testing.T, fake *fakeMounter) (*Manager, string) {
+	baseDir, err := ioutil.TempDir("", "sharemount")
+	assert.NoError(t, err)
+	manager, err := NewManager(fake, kerberos.NewManager(baseDir, time.Hour), healtchCheck.NewProber(time.Second, 1), baseDir, time.Hour)
+	assert.NoError(t, err)
+	return manager, baseDir
+}
+
+func TestManager_BrokenMountIsKeptUntilReleased(t *testing.T) {
+	fake := &fakeMounter{}
+	manager, baseDir := newTestManager(t, fake)
+	defer os.RemoveAll(baseDir)
+	defer manager.Stop()
+	secrets := map[string]string{"username": "user", "password": "secret"}
+
+	path, release, err := manager.Acquire(context.Background(), "//server/share", secrets, nil)
+	assert.NoError(t, err)
+	samePath, releaseSame, err := manager.Acquire(context.Background(), "//server/share", secrets, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, path, samePath)
+	releaseSame()
+
+	// The server went away, the next borrower gets a new mount
+	assert.NoError(t, os.RemoveAll(path))
+	newPath, releaseNew, err := manager.Acquire(context.Background(), "//server/share", secrets, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, path, newPath)
+	assert.Empty(t, fake.detached)
+
+	release()
+	assert.Equal(t, []string{path}, fake.detached)
+	releaseNew()
+}
+
+func TestManager_MountPointIsNotDerivedFromTheSecrets(t *testing.T) {
+	manager, baseDir := newTestManager(t, &fakeMounter{})
+	defer os.RemoveAll(baseDir)
+	defer manager.Stop()
+	otherManager, otherBaseDir := newTestManager(t, &fakeMounter{})
+	defer os.RemoveAll(otherBaseDir)
+	defer otherManager.Stop()
+	secrets := map[string]string{"username": "user", "password": "secret"}
+
+	assert.NotEqual(t, manager.mountKey("//server/share", secrets, nil), otherManager.mountKey("//server/share", secrets, nil))
+	path, release, err := manager.Acquire(context.Background(), "//server/share", secrets, nil)
+	assert.NoError(t, err)
+	defer release()
+	assert.NotContains(t, path, manager.mountKey("//server/share", secrets, nil)[:12])
+}
+
+func TestManager_FailedMountRemovesMountPoint(t *testing.T) {
+	fake := &fakeMounter{mountErr: errors.New("mount error(13): Permission denied")}
+	manager, baseDir := newTestManager(t, fake)
+	defer os.RemoveAll(baseDir)
+	defer manager.Stop()
+
+	_, _, err := manager.Acquire(context.Background(), "//server/share", map[string]string{"username": "user", "password": "wrong"}, nil)
+	assert.Error(t, err)
+	entries, _ := ioutil.ReadDir(baseDir)
+	assert.Empty(t, entries)
+}
+
+func TestManager_UnmountingIdleShareDoesNotBlockOtherShares(t *testing.T) {
+	fake := &fakeMounter{}
+	manager, baseDir := newTestManager(t, fake)
+	defer os.RemoveAll(baseDir)
+	defer manager.Stop()
+	secrets := map[string]string{"username": "user", "password": "secret"}
+
+	idlePath, release, err := manager.Acquire(context.Background(), "//server/idle", secrets, nil)
+	assert.NoError(t, err)
+	release()
+	idleBefore := time.Now()
+
+	// The server of the idle share hangs
+	fake.detaching = make(chan struct{})
+	fake.detachBlock = make(chan struct{})
+	unmounted := make(chan struct{})
+	go func() {
+		manager.unmountIdle(idleBefore)
+		close(unmounted)
+	}()
+	<-fake.detaching
+
+	acquired := make(chan struct{})
+	go func() {
+		_, releaseOther, err := manager.Acquire(context.Background(), "//server/other", secrets, nil)
+		assert.NoError(t, err)
+		releaseOther()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Acquiring another share waited for the idle share to be unmounted")
+	}
+
+	close(fake.detachBlock)
+	<-unmounted
+	fake.detachBlock = nil
+	assert.Equal(t, []string{idlePath}, fake.detached)
+	_, err = os.Stat(idlePath)
+	assert.True(t, os.IsNotExist(err))
+}
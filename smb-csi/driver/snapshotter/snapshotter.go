@@ -4,33 +4,54 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"smb-csi/driver/logging"
+	"smb-csi/driver/tracing"
 	"strings"
 )
 
-func CreateSnapshot(volumePath string, snapFileOut string) error {
+func CreateSnapshot(ctx context.Context, volumePath string, snapFileOut string) (err error) {
+	_, span := tracing.Start(ctx, "create snapshot", attribute.String("volumePath", volumePath), attribute.String("snapFile", snapFileOut))
+	defer func() { tracing.End(span, err) }()
+	log := logging.FromContext(ctx, "snapshotter").WithValues("volumePath", volumePath, "snapFile", snapFileOut)
+
+	log.V(4).Info("Creating snapshot")
 	var buf bytes.Buffer
 	if err := compress(volumePath, &buf); err != nil {
+		log.Error(err, "Compressing volume failed")
 		return err
 	}
 
 	if err := ioutil.WriteFile(snapFileOut, buf.Bytes(), 0777); err != nil {
+		log.Error(err, "Writing snapshot failed")
 		return err
 	}
+	log.V(2).Info("Created snapshot", "bytes", buf.Len())
 	return nil
 }
 
-func DeleteSnapshot(snapFile string) error {
+func DeleteSnapshot(ctx context.Context, snapFile string) (err error) {
+	_, span := tracing.Start(ctx, "delete snapshot", attribute.String("snapFile", snapFile))
+	defer func() { tracing.End(span, err) }()
+
+	logging.FromContext(ctx, "snapshotter").V(4).Info("Deleting snapshot", "snapFile", snapFile)
 	return os.RemoveAll(snapFile)
 }
 
-func ExtractSnap(snapFileIn string, outPath string) error {
+func ExtractSnap(ctx context.Context, snapFileIn string, outPath string) (err error) {
+	_, span := tracing.Start(ctx, "extract snapshot", attribute.String("snapFile", snapFileIn), attribute.String("outPath", outPath))
+	defer func() { tracing.End(span, err) }()
+	log := logging.FromContext(ctx, "snapshotter").WithValues("snapFile", snapFileIn, "outPath", outPath)
+
+	log.V(4).Info("Extracting snapshot")
 	if createDirErr := os.MkdirAll(outPath, os.ModeDir); createDirErr != nil {
 		return status.Errorf(codes.Internal, "Failed creating mount directory: %s", createDirErr.Error())
 	}
@@ -40,8 +61,10 @@ func ExtractSnap(snapFileIn string, outPath string) error {
 	}
 	buf := bytes.NewReader(content)
 	if err := decompress(buf, outPath); err != nil {
+		log.Error(err, "Decompressing snapshot failed")
 		return err
 	}
+	log.V(2).Info("Extracted snapshot", "bytes", len(content))
 	return nil
 }
 
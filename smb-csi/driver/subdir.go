@@ -0,0 +1,149 @@
+package driver
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// StorageClass parameter to name the volume directory after the pvc/pv metadata
+	subDirPatternKey = "subDirPattern"
+	// Volume context key holding the resolved volume directory, relative to the share
+	subDirKey = "subDir"
+
+	// Passed by the external-provisioner when started with --extra-create-metadata
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	pvNameKey       = "csi.storage.k8s.io/pv/name"
+
+	// Directory at the root of the share with one file per volume directory naming the volume which owns it.
+	// It lives outside of the volume directories, so the workloads can neither see nor change it.
+	volumeOwnersDir = ".csi-volume-owners"
+)
+
+var subDirPlaceholders = map[string]string{
+	"${pvc.metadata.name}":      pvcNameKey,
+	"${pvc.metadata.namespace}": pvcNamespaceKey,
+	"${pv.metadata.name}":       pvNameKey,
+}
+
+// resolveSubDir returns the directory of the volume relative to the share.
+// Without a subDirPattern the volume ID is used, as before.
+func resolveSubDir(volumeID string, parameters map[string]string) (string, error) {
+
+	pattern, isPatternPresent := parameters[subDirPatternKey]
+	if !isPatternPresent || pattern == "" {
+		return volumeID, nil
+	}
+
+	resolved := pattern
+	for placeholder, key := range subDirPlaceholders {
+		if !strings.Contains(resolved, placeholder) {
+			continue
+		}
+		value, isValuePresent := parameters[key]
+		if !isValuePresent || value == "" {
+			return "", status.Errorf(codes.InvalidArgument, "Placeholder %s used in subDirPattern, but %s is missing. Is the provisioner started with --extra-create-metadata?", placeholder, key)
+		}
+		resolved = strings.Replace(resolved, placeholder, value, -1)
+	}
+
+	if strings.Contains(resolved, "${") {
+		return "", status.Errorf(codes.InvalidArgument, "Unknown placeholder in subDirPattern: %s", pattern)
+	}
+
+	resolved = filepath.Clean(resolved)
+	if filepath.IsAbs(resolved) || resolved == "." || resolved == ".." || strings.HasPrefix(resolved, "../") ||
+		resolved == volumeOwnersDir || strings.HasPrefix(resolved, volumeOwnersDir+"/") {
+		return "", status.Errorf(codes.InvalidArgument, "subDirPattern %s resolves to invalid directory %s", pattern, resolved)
+	}
+
+	return resolved, nil
+}
+
+// volumeSubDir returns the directory of an existing volume relative to the share
+func volumeSubDir(volumeID string, volumeContext map[string]string) string {
+	if subDir, isSubDirPresent := volumeContext[subDirKey]; isSubDirPresent && subDir != "" {
+		return subDir
+	}
+	return volumeID
+}
+
+// buildVolumeContext strips the pvc/pv metadata from the parameters and records the resolved directory
+func buildVolumeContext(parameters map[string]string, subDir string) map[string]string {
+	volumeContext := make(map[string]string, len(parameters)+1)
+	for key, value := range parameters {
+		if key == pvcNameKey || key == pvcNamespaceKey || key == pvNameKey {
+			continue
+		}
+		volumeContext[key] = value
+	}
+	volumeContext[subDirKey] = subDir
+	return volumeContext
+}
+
+// volumeOwnerFile returns the file recording the owner of the volume directory
+func volumeOwnerFile(localSharePath string, subDir string) string {
+	return filepath.Join(localSharePath, volumeOwnersDir, url.PathEscape(subDir))
+}
+
+// claimVolumeDir records the volume as owner of its directory,
+// failing if the directory already belongs to a different volume.
+func claimVolumeDir(localSharePath string, subDir string, volumeID string) error {
+
+	ownerFile := volumeOwnerFile(localSharePath, subDir)
+	localVolumePath := filepath.Join(localSharePath, subDir)
+
+	owner, readErr := ioutil.ReadFile(ownerFile)
+	if readErr == nil {
+		return checkVolumeOwner(localVolumePath, strings.TrimSpace(string(owner)), volumeID)
+	}
+	if !os.IsNotExist(readErr) {
+		return status.Errorf(codes.Internal, "Failed reading owner of volume directory %s: %s", localVolumePath, readErr.Error())
+	}
+
+	entries, listErr := ioutil.ReadDir(localVolumePath)
+	if listErr != nil {
+		return status.Errorf(codes.Internal, "Failed reading volume directory %s: %s", localVolumePath, listErr.Error())
+	}
+	if len(entries) > 0 {
+		return status.Errorf(codes.AlreadyExists, "Volume directory %s already exists and is not empty", localVolumePath)
+	}
+
+	if mkdirErr := os.MkdirAll(filepath.Dir(ownerFile), 0755); mkdirErr != nil {
+		return status.Errorf(codes.Internal, "Failed creating %s: %s", filepath.Dir(ownerFile), mkdirErr.Error())
+	}
+	// Two volumes with the same directory may be created at the same time, only one of them creates the file
+	file, createErr := os.OpenFile(ownerFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(createErr) {
+		owner, readErr = ioutil.ReadFile(ownerFile)
+		if readErr != nil {
+			return status.Errorf(codes.Internal, "Failed reading owner of volume directory %s: %s", localVolumePath, readErr.Error())
+		}
+		return checkVolumeOwner(localVolumePath, strings.TrimSpace(string(owner)), volumeID)
+	}
+	if createErr != nil {
+		return status.Errorf(codes.Internal, "Failed claiming volume directory %s: %s", localVolumePath, createErr.Error())
+	}
+	_, writeErr := file.WriteString(volumeID)
+	if closeErr := file.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(ownerFile)
+		return status.Errorf(codes.Internal, "Failed claiming volume directory %s: %s", localVolumePath, writeErr.Error())
+	}
+	return nil
+}
+
+func checkVolumeOwner(localVolumePath string, owner string, volumeID string) error {
+	if owner != volumeID {
+		return status.Errorf(codes.AlreadyExists, "Volume directory %s is already used by volume %s", localVolumePath, owner)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package driver
+
+import (
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClaimVolumeDir_RecordsOwnerOutsideOfVolumeDir(t *testing.T) {
+	share, _ := ioutil.TempDir("", "share")
+	defer os.RemoveAll(share)
+	os.MkdirAll(filepath.Join(share, "ns/claim"), 0755)
+
+	assert.NoError(t, claimVolumeDir(share, "ns/claim", "pvc-1"))
+	entries, _ := ioutil.ReadDir(filepath.Join(share, "ns/claim"))
+	assert.Empty(t, entries)
+	// Claiming again is idempotent, another volume is rejected even once the directory got populated
+	assert.NoError(t, claimVolumeDir(share, "ns/claim", "pvc-1"))
+	ioutil.WriteFile(filepath.Join(share, "ns/claim/data"), []byte("data"), 0644)
+	assert.Equal(t, codes.AlreadyExists, status.Code(claimVolumeDir(share, "ns/claim", "pvc-2")))
+}
+
+func TestClaimVolumeDir_RejectsUnclaimedDirWithData(t *testing.T) {
+	share, _ := ioutil.TempDir("", "share")
+	defer os.RemoveAll(share)
+	os.MkdirAll(filepath.Join(share, "data"), 0755)
+	ioutil.WriteFile(filepath.Join(share, "data/file"), []byte("data"), 0644)
+
+	assert.Equal(t, codes.AlreadyExists, status.Code(claimVolumeDir(share, "data", "pvc-1")))
+	_, err := os.Stat(volumeOwnerFile(share, "data"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestResolveSubDir_RejectsOwnersDir(t *testing.T) {
+	_, err := resolveSubDir("pvc-1", map[string]string{subDirPatternKey: volumeOwnersDir + "/${pvc.metadata.name}", pvcNameKey: "claim"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = resolveSubDir("pvc-1", map[string]string{subDirPatternKey: "./" + volumeOwnersDir, pvcNameKey: "claim"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
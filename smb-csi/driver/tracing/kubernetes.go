@@ -0,0 +1,40 @@
+package tracing
+
+import (
+	"fmt"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// WrapTransport adds a span for every request to the Kubernetes API made within a traced operation,
+// it is meant for the WrapTransport of the rest config of the Kubernetes clients
+func WrapTransport(transport http.RoundTripper) http.RoundTripper {
+	return &kubernetesTransport{transport: transport}
+}
+
+type kubernetesTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *kubernetesTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// Requests outside of an operation, like the event broadcaster's, would only start traces of their own
+	if !trace.SpanContextFromContext(request.Context()).IsValid() {
+		return t.transport.RoundTrip(request)
+	}
+
+	ctx, span := Start(request.Context(), fmt.Sprintf("kubernetes %s %s", request.Method, request.URL.Path),
+		semconv.HTTPMethodKey.String(request.Method),
+		semconv.HTTPURLKey.String(request.URL.String()),
+	)
+	response, err := t.transport.RoundTrip(request.WithContext(ctx))
+	spanErr := err
+	if err == nil {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(response.StatusCode))
+		if response.StatusCode >= http.StatusBadRequest {
+			spanErr = fmt.Errorf("%s", response.Status)
+		}
+	}
+	End(span, spanErr)
+	return response, err
+}
@@ -0,0 +1,172 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// Spans are exported over OTLP/gRPC to a collector
+	ExporterOTLP = "otlp"
+	// Spans are appended as JSON to a local file
+	ExporterFile = "file"
+
+	tracerName = "smb-csi/driver"
+)
+
+// Config selects the exporter of the spans, tracing is disabled without an exporter
+type Config struct {
+	Exporter string
+	// OTLP endpoint like collector:4317, http://collector:4317 for a collector without TLS.
+	// Empty to use OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4317.
+	Endpoint string
+	// File the file exporter appends the spans to
+	File string
+	// Mode of the driver, controller or node
+	Mode   string
+	NodeID string
+}
+
+// Setup installs the tracer provider and the W3C trace context propagator.
+// The returned function flushes the spans which are not exported yet and stops the exporter.
+func Setup(config Config) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	switch config.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		var options []otlptracegrpc.Option
+		if endpoint := config.Endpoint; endpoint != "" {
+			if strings.HasPrefix(endpoint, "http://") {
+				options = append(options, otlptracegrpc.WithInsecure())
+			}
+			endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+			options = append(options, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		otlpExporter, err := otlptracegrpc.New(context.Background(), options...)
+		if err != nil {
+			return nil, err
+		}
+		exporter = otlpExporter
+	case ExporterFile:
+		file, err := os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, err
+		}
+		fileExporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		exporter = &closingExporter{SpanExporter: fileExporter, file: file}
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q, supported are %s and %s", config.Exporter, ExporterOTLP, ExporterFile)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		// The sidecars decide if a trace they started is sampled
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("smb-csi-"+config.Mode),
+			semconv.HostNameKey.String(config.NodeID),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// closingExporter closes the file of the file exporter on shutdown
+type closingExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+func (e *closingExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Start starts a span, which is a child of the span in the context if there is one
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End ends the span, marking it as failed with the error if there is one
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StartRPC starts the server span of a gRPC request, a child of the span of the caller if it sent its trace context
+func StartRPC(ctx context.Context, fullMethod string) (context.Context, trace.Span) {
+	service, method := path.Split(strings.TrimPrefix(fullMethod, "/"))
+	return otel.Tracer(tracerName).Start(ExtractGRPC(ctx), fullMethod,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String("grpc"),
+			semconv.RPCServiceKey.String(strings.TrimSuffix(service, "/")),
+			semconv.RPCMethodKey.String(method),
+		),
+	)
+}
+
+// EndRPC ends the server span of a gRPC request with the status code of the response
+func EndRPC(span trace.Span, err error) {
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(status.Code(err))))
+	End(span, err)
+}
+
+// ExtractGRPC returns the context with the trace context the caller sent in the gRPC metadata, if it sent one
+func ExtractGRPC(ctx context.Context) context.Context {
+	md, isMetadataPresent := metadata.FromIncomingContext(ctx)
+	if !isMetadataPresent {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+}
+
+// metadataCarrier reads and writes the trace context in gRPC metadata, whose keys are lower case
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
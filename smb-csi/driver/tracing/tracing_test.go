@@ -0,0 +1,40 @@
+package tracing
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetup_ContinuesTraceOfSidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	traceFile := filepath.Join(dir, "traces.json")
+
+	stopTracing, err := Setup(Config{Exporter: ExporterFile, File: traceFile, Mode: "node", NodeID: "testNode"})
+	assert.NoError(t, err)
+
+	incoming := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"))
+	ctx, span := StartRPC(incoming, "/csi.v1.Node/NodePublishVolume")
+	_, child := Start(ctx, "bind mount")
+	End(child, nil)
+	EndRPC(span, nil)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.SpanContext().TraceID().String())
+	assert.Equal(t, span.SpanContext().TraceID(), child.SpanContext().TraceID())
+
+	assert.NoError(t, stopTracing(context.Background()))
+	traces, err := ioutil.ReadFile(traceFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(traces), "/csi.v1.Node/NodePublishVolume")
+	assert.Contains(t, string(traces), "bind mount")
+}
+
+func TestSetup_UnknownExporter(t *testing.T) {
+	_, err := Setup(Config{Exporter: "zipkin"})
+	assert.Error(t, err)
+}
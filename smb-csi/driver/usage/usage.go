@@ -0,0 +1,327 @@
+package usage
+
+import (
+	"context"
+	"io/ioutil"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Entries walked between two pauses of a walk
+	walkBatchSize = 100
+	// Every this many walks of a volume list all of its directories. In between, only directories whose
+	// modification time changed are listed again, which misses files growing in place.
+	fullWalkInterval = 10
+)
+
+// Usage is what the files of a volume directory use
+type Usage struct {
+	Bytes  int64
+	Inodes int64
+	// When the walk the usage was computed by finished
+	UpdatedAt time.Time
+}
+
+// Tracker computes the usage of volumes by walking their directory, as statfs on a share reports the whole share.
+// Walking a share is slow and loads the server, so the volumes are walked one after another in the background,
+// limited to a number of entries per second, and the result of the last finished walk is served meanwhile.
+// A volume is walked once, however many pods it is published to.
+type Tracker struct {
+	refreshInterval  time.Duration
+	walkTimeout      time.Duration
+	entriesPerSecond int
+
+	mutex   sync.Mutex
+	volumes map[string]*trackedVolume
+	// IDs of volumes which were never walked, walked before the periodic refresh
+	requests chan string
+	// Cancelled by Stop, ends the running walk
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type trackedVolume struct {
+	// Published paths of the volume, any of them is walked
+	paths   map[string]bool
+	usage   *Usage
+	pending bool
+	// A walk runs, or hangs on an unreachable server after it timed out
+	walking bool
+	// Directories of the last walk by their path relative to the volume, reused while their modification time is unchanged
+	dirs  map[string]*dirUsage
+	walks int
+}
+
+// dirUsage is what the entries directly in a directory use, subdirectories excluded
+type dirUsage struct {
+	modTime time.Time
+	bytes   int64
+	inodes  int64
+	subDirs []string
+}
+
+func NewTracker(refreshInterval time.Duration, walkTimeout time.Duration, entriesPerSecond int) *Tracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	tracker := &Tracker{
+		refreshInterval:  refreshInterval,
+		walkTimeout:      walkTimeout,
+		entriesPerSecond: entriesPerSecond,
+		volumes:          make(map[string]*trackedVolume),
+		requests:         make(chan string, 64),
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+	go tracker.run()
+	return tracker
+}
+
+// Get returns the last computed usage of the volume published at the path, or false if its first walk has not finished yet.
+// The volume is walked again every refresh interval until all of its paths are forgotten.
+func (t *Tracker) Get(volumeID string, path string) (*Usage, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	volume, isTracked := t.volumes[volumeID]
+	if !isTracked {
+		volume = &trackedVolume{paths: make(map[string]bool)}
+		t.volumes[volumeID] = volume
+	}
+	volume.paths[path] = true
+	if volume.usage == nil && !volume.pending {
+		select {
+		case t.requests <- volumeID:
+			volume.pending = true
+		default:
+			// The periodic refresh picks the volume up
+		}
+	}
+	if volume.usage == nil {
+		return nil, false
+	}
+	return volume.usage, true
+}
+
+// Forget stops walking the volume at the path, e.g. after it was unpublished.
+// The volume is not tracked anymore once its last path is forgotten.
+func (t *Tracker) Forget(volumeID string, path string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	volume, isTracked := t.volumes[volumeID]
+	if !isTracked {
+		return
+	}
+	delete(volume.paths, path)
+	if len(volume.paths) == 0 {
+		delete(t.volumes, volumeID)
+	}
+}
+
+// Stop ends the background walks, a walk hanging on an unreachable server is abandoned
+func (t *Tracker) Stop() {
+	t.cancel()
+}
+
+func (t *Tracker) run() {
+	ticker := time.NewTicker(t.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case volumeID := <-t.requests:
+			t.refresh(volumeID)
+		case <-ticker.C:
+			for _, volumeID := range t.trackedVolumes() {
+				t.refresh(volumeID)
+			}
+		}
+	}
+}
+
+func (t *Tracker) trackedVolumes() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	volumeIDs := make([]string, 0, len(t.volumes))
+	for volumeID := range t.volumes {
+		volumeIDs = append(volumeIDs, volumeID)
+	}
+	return volumeIDs
+}
+
+// refresh walks the volume, waiting at most the walk timeout for it.
+// A stat on a hard mount of an unreachable server never returns, so such a walk is left behind
+// and the volume is not walked again until it returned.
+func (t *Tracker) refresh(volumeID string) {
+	t.mutex.Lock()
+	volume, isTracked := t.volumes[volumeID]
+	if !isTracked || volume.walking || len(volume.paths) == 0 {
+		t.mutex.Unlock()
+		return
+	}
+	paths := make([]string, 0, len(volume.paths))
+	for path := range volume.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	path := paths[0]
+	previous := volume.dirs
+	if volume.walks%fullWalkInterval == 0 {
+		previous = nil
+	}
+	volume.walking = true
+	t.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(t.ctx, t.walkTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		usage, dirs, err := t.walk(ctx, path, previous)
+
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		volume.walking = false
+		volume.pending = false
+		if err != nil {
+			if ctx.Err() == nil {
+				klog.Infof("Failed computing the usage of volume %s at %s: %s", volumeID, path, err.Error())
+			}
+			return
+		}
+		volume.usage = usage
+		volume.dirs = dirs
+		volume.walks++
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			klog.Infof("Computing the usage of volume %s at %s did not finish within %s", volumeID, path, t.walkTimeout)
+		}
+	}
+}
+
+// walker sums up the usage of a volume, pausing after every batch of entries to stay within the entries per second
+type walker struct {
+	ctx              context.Context
+	entriesPerSecond int
+	root             string
+	previous         map[string]*dirUsage
+	dirs             map[string]*dirUsage
+	usage            *Usage
+	batchStart       time.Time
+	batchEntries     int
+}
+
+// walk computes the usage of the volume at the root. Directories of the previous walk whose modification time
+// is unchanged are not listed again, their entries are taken from the previous walk.
+// Entries removed or not readable while walking are skipped.
+func (t *Tracker) walk(ctx context.Context, root string, previous map[string]*dirUsage) (*Usage, map[string]*dirUsage, error) {
+	w := &walker{
+		ctx:              ctx,
+		entriesPerSecond: t.entriesPerSecond,
+		root:             root,
+		previous:         previous,
+		dirs:             make(map[string]*dirUsage),
+		usage:            &Usage{},
+		batchStart:       time.Now(),
+	}
+	if err := w.walkDir("."); err != nil {
+		return nil, nil, err
+	}
+	w.usage.UpdatedAt = time.Now()
+	return w.usage, w.dirs, nil
+}
+
+func (w *walker) walkDir(relativePath string) error {
+	path := filepath.Join(w.root, relativePath)
+	info, err := os.Lstat(path)
+	if err != nil {
+		if relativePath == "." {
+			return err
+		}
+		w.skip(path, err)
+		return nil
+	}
+	if err := w.count(); err != nil {
+		return err
+	}
+	w.usage.Inodes++
+
+	dir, isKnown := w.previous[relativePath]
+	if !isKnown || !dir.modTime.Equal(info.ModTime()) {
+		if dir, err = w.listDir(relativePath, info.ModTime()); err != nil {
+			if relativePath == "." || err == w.ctx.Err() {
+				return err
+			}
+			w.skip(path, err)
+			return nil
+		}
+	}
+	w.dirs[relativePath] = dir
+	w.usage.Bytes += dir.bytes
+	w.usage.Inodes += dir.inodes
+
+	for _, subDir := range dir.subDirs {
+		if err := w.walkDir(filepath.Join(relativePath, subDir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listDir sums up the entries directly in the directory
+func (w *walker) listDir(relativePath string, modTime time.Time) (*dirUsage, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(w.root, relativePath))
+	if err != nil {
+		return nil, err
+	}
+	dir := &dirUsage{modTime: modTime}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dir.subDirs = append(dir.subDirs, entry.Name())
+			continue
+		}
+		if err := w.count(); err != nil {
+			return nil, err
+		}
+		dir.inodes++
+		if entry.Mode().IsRegular() {
+			dir.bytes += entry.Size()
+		}
+	}
+	return dir, nil
+}
+
+// count counts an entry against the entries per second and ends the walk once it got cancelled
+func (w *walker) count() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if w.batchEntries++; w.batchEntries < walkBatchSize || w.entriesPerSecond <= 0 {
+		return nil
+	}
+	pause := time.Duration(w.batchEntries)*time.Second/time.Duration(w.entriesPerSecond) - time.Since(w.batchStart)
+	if pause > 0 {
+		select {
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+	w.batchStart = time.Now()
+	w.batchEntries = 0
+	return nil
+}
+
+func (w *walker) skip(path string, err error) {
+	if !os.IsNotExist(err) {
+		klog.Infof("Skipping %s while computing the usage of %s: %s", path, w.root, err.Error())
+	}
+}
@@ -0,0 +1,116 @@
+package usage
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTracker_VolumeDirectory(t *testing.T) {
+	volumePath, err := ioutil.TempDir("", "usage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(volumePath)
+	assert.NoError(t, os.Mkdir(filepath.Join(volumePath, "dir"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(volumePath, "file"), make([]byte, 1000), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(volumePath, "dir", "file"), make([]byte, 24), 0644))
+
+	tracker := NewTracker(time.Hour, time.Minute, 0)
+	defer tracker.Stop()
+
+	_, isUsageKnown := tracker.Get("volume", volumePath)
+	assert.False(t, isUsageKnown)
+	assert.Eventually(t, func() bool {
+		_, isUsageKnown := tracker.Get("volume", volumePath)
+		return isUsageKnown
+	}, 5*time.Second, 10*time.Millisecond)
+
+	volumeUsage, _ := tracker.Get("volume", volumePath)
+	assert.Equal(t, int64(1024), volumeUsage.Bytes)
+	// The volume directory, dir and both files
+	assert.Equal(t, int64(4), volumeUsage.Inodes)
+}
+
+func TestTracker_VolumePublishedTwiceIsTrackedOnce(t *testing.T) {
+	volumePath, err := ioutil.TempDir("", "usage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(volumePath)
+
+	tracker := NewTracker(time.Hour, time.Minute, 0)
+	defer tracker.Stop()
+
+	tracker.Get("volume", volumePath)
+	assert.Eventually(t, func() bool {
+		_, isUsageKnown := tracker.Get("volume", volumePath)
+		return isUsageKnown
+	}, 5*time.Second, 10*time.Millisecond)
+	// Another pod of the same volume gets the usage of the first walk
+	_, isUsageKnown := tracker.Get("volume", "/var/lib/kubelet/pods/other/volume")
+	assert.True(t, isUsageKnown)
+	assert.Len(t, tracker.trackedVolumes(), 1)
+
+	tracker.Forget("volume", volumePath)
+	_, isUsageKnown = tracker.Get("volume", "/var/lib/kubelet/pods/other/volume")
+	assert.True(t, isUsageKnown)
+	tracker.Forget("volume", "/var/lib/kubelet/pods/other/volume")
+	assert.Empty(t, tracker.trackedVolumes())
+}
+
+func TestTracker_WalkListsChangedDirectoriesOnly(t *testing.T) {
+	volumePath, err := ioutil.TempDir("", "usage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(volumePath)
+	assert.NoError(t, os.Mkdir(filepath.Join(volumePath, "unchanged"), 0755))
+	assert.NoError(t, os.Mkdir(filepath.Join(volumePath, "changed"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(volumePath, "unchanged", "file"), make([]byte, 100), 0644))
+	tracker := &Tracker{}
+
+	volumeUsage, dirs, err := tracker.walk(context.Background(), volumePath, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), volumeUsage.Bytes)
+	assert.Equal(t, int64(4), volumeUsage.Inodes)
+
+	// A file growing in place does not change its directory, a new file does
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(volumePath, "unchanged", "file"), make([]byte, 200), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(volumePath, "changed", "file"), make([]byte, 10), 0644))
+	unchanged, _ := os.Stat(filepath.Join(volumePath, "unchanged"))
+	changedTime := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(volumePath, "changed"), changedTime, changedTime))
+	assert.NoError(t, os.Chtimes(filepath.Join(volumePath, "unchanged"), unchanged.ModTime(), unchanged.ModTime()))
+
+	volumeUsage, dirs, err = tracker.walk(context.Background(), volumePath, dirs)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(110), volumeUsage.Bytes)
+	assert.Equal(t, int64(5), volumeUsage.Inodes)
+
+	// A full walk picks up the grown file
+	volumeUsage, _, err = tracker.walk(context.Background(), volumePath, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(210), volumeUsage.Bytes)
+}
+
+func TestTracker_WalkIsAbandonedAfterTimeout(t *testing.T) {
+	volumePath, err := ioutil.TempDir("", "usage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(volumePath)
+	for i := 0; i < 2*walkBatchSize; i++ {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(volumePath, fmt.Sprintf("file%d", i)), nil, 0644))
+	}
+
+	// At one entry per second, the walk pauses for 100s after its first batch
+	tracker := NewTracker(time.Hour, 50*time.Millisecond, 1)
+	defer tracker.Stop()
+	tracker.Get("volume", volumePath)
+
+	assert.Eventually(t, func() bool {
+		tracker.mutex.Lock()
+		defer tracker.mutex.Unlock()
+		return tracker.volumes["volume"].walks == 0 && !tracker.volumes["volume"].pending
+	}, 5*time.Second, 10*time.Millisecond)
+	_, isUsageKnown := tracker.Get("volume", volumePath)
+	assert.False(t, isUsageKnown)
+}
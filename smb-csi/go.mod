@@ -5,8 +5,12 @@ go 1.13
 replace smb-csi/driver => ./driver
 
 require (
-	github.com/container-storage-interface/spec v1.4.0
-	github.com/stretchr/testify v1.6.1
+	github.com/container-storage-interface/spec v1.5.0
+	github.com/stretchr/testify v1.7.0
+	google.golang.org/grpc v1.41.0
+	k8s.io/api v0.21.1
+	k8s.io/apimachinery v0.21.1
+	k8s.io/client-go v0.21.1
 	k8s.io/klog v1.0.0 // indirect
 	k8s.io/klog/v2 v2.8.0
 	smb-csi/driver v0.0.0-00010101000000-000000000000
@@ -6,6 +6,8 @@ make
 docker build -t seitenbau/smb-csi-driver .
 make clean
 
+kubectl apply -f deploy/driver/smb-driverinfo.yml
+
 # Creating Controller Server
 kubectl apply -f deploy/driver/controller/rbac-controller-server.yml
 kubectl apply -f deploy/driver/controller/controller-server.yml
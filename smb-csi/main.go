@@ -11,9 +11,32 @@ import (
 var (
 	endpoint = flag.String("endpoint","/csi/csi.sock","CSI UNIX Domain Socket Endpoint")
 	nodeid = flag.String("nodeid","","ID of Node passed from kube args")
+	shareIdleTimeout = flag.Duration("share-idle-timeout", smb.DefaultConfig().ShareIdleTimeout, "Time after which an unused share mount of the controller is unmounted")
+	krb5CacheDir = flag.String("krb5-cache-dir", smb.DefaultConfig().Krb5CacheDir, "Host path for the Kerberos credential caches of the staged volumes")
+	krb5RenewInterval = flag.Duration("krb5-renew-interval", smb.DefaultConfig().Krb5RenewInterval, "Interval in which the Kerberos tickets of the staged volumes are renewed")
+	dfsTargetTTL = flag.Duration("dfs-target-ttl", smb.DefaultConfig().DFSTargetTTL, "Time the controller mounts the target a DFS path was resolved to, before resolving it again")
+	usageRefreshInterval = flag.Duration("usage-refresh-interval", smb.DefaultConfig().UsageRefreshInterval, "Interval in which the usage of the published volumes is computed again")
+	usageWalkRate = flag.Int("usage-walk-rate", smb.DefaultConfig().UsageWalkRate, "Files and directories per second walked while computing the usage of a volume, 0 for no limit")
+	usageWalkTimeout = flag.Duration("usage-walk-timeout", smb.DefaultConfig().UsageWalkTimeout, "Time a walk computing the usage of a volume may take before it is abandoned")
+	probeTimeout = flag.Duration("probe-timeout", smb.DefaultConfig().ProbeTimeout, "Time a stat or statfs of a volume path may take before the volume is reported abnormal")
+	probeWorkers = flag.Int("probe-workers", smb.DefaultConfig().ProbeWorkers, "Filesystem probes of volume paths running at the same time")
+	activeProbe = flag.Bool("active-probe", smb.DefaultConfig().ActiveProbe, "Check the volume condition by writing and reading back a hidden file in the volume")
+	activeProbeSlowThreshold = flag.Duration("active-probe-slow-threshold", smb.DefaultConfig().ActiveProbeSlowThreshold, "Latency above which the active probe reports a volume as slow, 0 to not check it")
+	remountCheckInterval = flag.Duration("remount-check-interval", smb.DefaultConfig().RemountCheckInterval, "Interval in which the stage mounts are checked and mounted again if they are broken, 0 to not check them")
+	remountMaxAttempts = flag.Int("remount-max-attempts", smb.DefaultConfig().RemountMaxAttempts, "Attempts to mount a broken stage mount again before giving up")
+	journalPath = flag.String("journal-path", smb.DefaultConfig().JournalPath, "File of the node journal of the stage and publish mounts, which has to survive restarts of the node plugin, empty to not journal them")
+	metricsAddress = flag.String("metrics-address", smb.DefaultConfig().MetricsAddress, "Address like :9810 the Prometheus metrics are served at, empty to not serve them")
+	mode = flag.String("mode", smb.DefaultConfig().Mode, "Mode the driver runs in, controller or node, which labels the metrics and traces")
+	tracingExporter = flag.String("tracing-exporter", smb.DefaultConfig().TracingExporter, "Exporter of the OpenTelemetry traces, otlp or file, empty to not trace the requests")
+	tracingEndpoint = flag.String("tracing-endpoint", smb.DefaultConfig().TracingEndpoint, "OTLP/gRPC endpoint like collector:4317 of the otlp exporter, http://collector:4317 for one without TLS, empty for OTEL_EXPORTER_OTLP_ENDPOINT")
+	tracingFile = flag.String("tracing-file", smb.DefaultConfig().TracingFile, "File the file exporter appends the spans to")
+	logFormat = flag.String("log-format", smb.DefaultConfig().LogFormat, "Format of the log lines, text or json")
+	logVerbosity = flag.String("log-verbosity", smb.DefaultConfig().LogVerbosity, "Comma separated verbosity of subsystems like mounter=5,snapshotter=2, the others log at the verbosity of -v")
+	mountOptionsAllowlist = flag.String("mount-options-allowlist", strings.Join(smb.DefaultConfig().MountOptionsAllowlist, ","), "Comma separated mount options which may be set in the mountOptions of a StorageClass or PV")
 )
 
 func main() {
+	klog.InitFlags(nil)
 	flag.Parse()
 	if *endpoint == "" {
 		klog.Fatalln("No valid UNIX Domain Socket specified")
@@ -24,7 +47,31 @@ func main() {
 	if !strings.HasPrefix(*endpoint, "unix://") {
 		*endpoint = "unix://" + *endpoint
 	}
-	driver, driverErr := smb.NewDriver(*nodeid)
+	config := smb.DefaultConfig()
+	config.ShareIdleTimeout = *shareIdleTimeout
+	config.Krb5CacheDir = *krb5CacheDir
+	config.Krb5RenewInterval = *krb5RenewInterval
+	config.MountOptionsAllowlist = strings.Split(*mountOptionsAllowlist, ",")
+	config.DFSTargetTTL = *dfsTargetTTL
+	config.UsageRefreshInterval = *usageRefreshInterval
+	config.UsageWalkRate = *usageWalkRate
+	config.UsageWalkTimeout = *usageWalkTimeout
+	config.ProbeTimeout = *probeTimeout
+	config.ProbeWorkers = *probeWorkers
+	config.ActiveProbe = *activeProbe
+	config.ActiveProbeSlowThreshold = *activeProbeSlowThreshold
+	config.RemountCheckInterval = *remountCheckInterval
+	config.RemountMaxAttempts = *remountMaxAttempts
+	config.JournalPath = *journalPath
+	config.MetricsAddress = *metricsAddress
+	config.Mode = *mode
+	config.TracingExporter = *tracingExporter
+	config.TracingEndpoint = *tracingEndpoint
+	config.TracingFile = *tracingFile
+	config.LogFormat = *logFormat
+	config.LogVerbosity = *logVerbosity
+
+	driver, driverErr := smb.NewDriver(*nodeid, config)
 	if driverErr != nil {
 		klog.Fatalln(driverErr)
 		os.Exit(1)
@@ -3,6 +3,10 @@ package test
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"smb-csi/driver/mock"
 	"testing"
 )
 
@@ -28,6 +32,150 @@ func TestCreateVolume_NoShare(t *testing.T) {
 	assert.Nil(t, resp)
 }
 
+func TestCreateVolume_UnknownSubDirPlaceholder(t *testing.T) {
+	req := csi.CreateVolumeRequest{
+		Name: testVolName,
+		Parameters: map[string]string{"server": "127.0.0.1", "share": "/share1", "subDirPattern": "${pvc.metadata.uid}"},
+	}
+	resp, err := d.CreateVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestCreateVolume_SubDirPatternWithoutMetadata(t *testing.T) {
+	req := csi.CreateVolumeRequest{
+		Name: testVolName,
+		Parameters: map[string]string{"server": "127.0.0.1", "share": "/share1", "subDirPattern": "${pvc.metadata.namespace}/${pvc.metadata.name}"},
+	}
+	resp, err := d.CreateVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestCreateVolume_InvalidDirMode(t *testing.T) {
+	req := csi.CreateVolumeRequest{
+		Name: testVolName,
+		Parameters: map[string]string{"server": "127.0.0.1", "share": "/share1", "dirMode": "rwxr-xr-x"},
+	}
+	resp, err := d.CreateVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestCreateVolume_UnknownSecurityMode(t *testing.T) {
+	req := csi.CreateVolumeRequest{
+		Name: testVolName,
+		Parameters: map[string]string{"server": "127.0.0.1", "share": "/share1", "sec": "lanman"},
+	}
+	resp, err := d.CreateVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestCreateVolume_InvalidSMBVersion(t *testing.T) {
+	req := csi.CreateVolumeRequest{
+		Name: testVolName,
+		Parameters: map[string]string{"server": "127.0.0.1", "share": "/share1", "smbVersion": "4.0"},
+	}
+	resp, err := d.CreateVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestCreateVolume_CredentialMountOption(t *testing.T) {
+	req := csi.CreateVolumeRequest{
+		Name: testVolName,
+		Parameters: map[string]string{"server": "127.0.0.1", "share": "/share1"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"password=secret"}},
+				},
+			},
+		},
+	}
+	resp, err := d.CreateVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestCreateVolume_EncryptionWithoutSMB3(t *testing.T) {
+	req := csi.CreateVolumeRequest{
+		Name: testVolName,
+		Parameters: map[string]string{"server": "127.0.0.1", "share": "/share1", "smbVersion": "2.1", "requireEncryption": "true"},
+	}
+	resp, err := d.CreateVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestCreateVolume_KerberosWithoutPrincipal(t *testing.T) {
+	req := csi.CreateVolumeRequest{
+		Name: testVolName,
+		Parameters: map[string]string{"server": "127.0.0.1", "share": "/share1", "sec": "krb5"},
+		Secrets: map[string]string{"username": "user", "password": "password"},
+	}
+	resp, err := d.CreateVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestCreateVolume_KerberosMountOptionWithoutPrincipal(t *testing.T) {
+	req := csi.CreateVolumeRequest{
+		Name: testVolName,
+		Parameters: map[string]string{"server": "127.0.0.1", "share": "/share1"},
+		Secrets: map[string]string{"username": "user", "password": "password"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"sec=krb5"}},
+				},
+			},
+		},
+	}
+	resp, err := d.CreateVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestCreateVolume_ExistingVolumeReturnsContextOfFirstCreate(t *testing.T) {
+	createDriver, err := mock.NewMockDriver("test")
+	assert.NoError(t, err)
+	createDriver.PVClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{Name: "existingID"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					VolumeHandle: "existingID",
+					VolumeAttributes: map[string]string{"server": "127.0.0.1", "share": "share1", "subDir": "existingID", "ownership": "mount", "negotiatedSMBVersion": "3.0"},
+				},
+			},
+		},
+	}).CoreV1().PersistentVolumes()
+	req := csi.CreateVolumeRequest{
+		Name: "existingID",
+		Parameters: map[string]string{"server": "127.0.0.1", "share": "share1", "smbVersion": "auto"},
+	}
+	resp, err := createDriver.CreateVolume(ctx, &req)
+	assert.NoError(t, err)
+	assert.Equal(t, "mount", resp.Volume.VolumeContext["ownership"])
+	assert.Equal(t, "3.0", resp.Volume.VolumeContext["negotiatedSMBVersion"])
+}
+
+func TestCreateVolume_UsesCachedDFSTarget(t *testing.T) {
+	dfsDriver, err := mock.NewMockDriver("test")
+	assert.NoError(t, err)
+	dfsDriver.PVClient = fake.NewSimpleClientset().CoreV1().PersistentVolumes()
+	dfsDriver.DFS.Record("//corp.example/dfs/team", "//fs1.corp.example/team")
+	req := csi.CreateVolumeRequest{
+		Name: "dfsID",
+		Parameters: map[string]string{"server": "corp.example", "share": "dfs/team"},
+	}
+	// The fake share mount has no directory to create the volume in, only the mounted share matters
+	dfsDriver.CreateVolume(ctx, &req)
+	assert.Equal(t, []string{"//fs1.corp.example/team"}, dfsDriver.Mounter.(*mock.FakeMounter).Sources)
+}
+
 func TestPublishVolume_NoServer(t *testing.T) {
 	req := csi.ControllerPublishVolumeRequest{
 		NodeId: "test",
@@ -50,6 +198,82 @@ func TestPublishVolume_NoShare(t *testing.T) {
 	assert.Nil(t, resp)
 }
 
+func publishOnNode(t *testing.T, nodeID string, mode csi.VolumeCapability_AccessMode_Mode) (*csi.ControllerPublishVolumeResponse, error) {
+	attachDriver, err := mock.NewMockDriver("test")
+	assert.NoError(t, err)
+	attachDriver.PVClient = attachPVs
+	req := csi.ControllerPublishVolumeRequest{
+		NodeId: nodeID,
+		VolumeId: "attachID",
+		VolumeContext: map[string]string{"server": "127.0.0.1", "share": "share1"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		},
+	}
+	return attachDriver.ControllerPublishVolume(ctx, &req)
+}
+
+var attachPVs = fake.NewSimpleClientset(&corev1.PersistentVolume{ObjectMeta: v1.ObjectMeta{Name: "attachID"}}).CoreV1().PersistentVolumes()
+
+func TestPublishVolume_NoNodeID(t *testing.T) {
+	req := csi.ControllerPublishVolumeRequest{
+		VolumeId: "testID",
+		VolumeContext: map[string]string{"server": "127.0.0.1", "share": "share1"},
+	}
+	resp, err := d.ControllerPublishVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestPublishVolume_SingleNodeOnSecondNode(t *testing.T) {
+	resp, err := publishOnNode(t, "node1", csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+
+	// Publishing on the same node again is idempotent
+	resp, err = publishOnNode(t, "node1", csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+
+	resp, err = publishOnNode(t, "node2", csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+
+	unpublishDriver, _ := mock.NewMockDriver("test")
+	unpublishDriver.PVClient = attachPVs
+	unpublishResp, err := unpublishDriver.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "attachID", NodeId: "node1"})
+	assert.NoError(t, err)
+	assert.NotNil(t, unpublishResp)
+
+	resp, err = publishOnNode(t, "node2", csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+	unpublishDriver.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "attachID", NodeId: "node2"})
+}
+
+func TestUnpublishVolume_DeletedVolume(t *testing.T) {
+	unpublishDriver, _ := mock.NewMockDriver("test")
+	unpublishDriver.PVClient = fake.NewSimpleClientset().CoreV1().PersistentVolumes()
+	resp, err := unpublishDriver.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "deletedID", NodeId: "node1"})
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+
+	resp, err = unpublishDriver.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "deletedID"})
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+}
+
+func TestPublishVolume_MultiNodeOnSecondNode(t *testing.T) {
+	resp, err := publishOnNode(t, "node1", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+
+	resp, err = publishOnNode(t, "node2", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+}
+
 func TestDeleteVolume(t *testing.T) {
 	req := csi.DeleteVolumeRequest{
 		VolumeId: "testID",
@@ -75,4 +299,20 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 	assert.Empty(t, resp.Message)
 }
 
+func TestValidateVolumeCapabilities_SingleNodeSingleWriter(t *testing.T) {
+	req := csi.ValidateVolumeCapabilitiesRequest{
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+				},
+			},
+		},
+	}
+	resp, err := d.ValidateVolumeCapabilities(ctx, &req)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+	assert.Empty(t, resp.Message)
+}
+
 
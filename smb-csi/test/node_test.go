@@ -3,6 +3,13 @@ package test
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"smb-csi/driver/journal"
+	"smb-csi/driver/mock"
 	"testing"
 )
 
@@ -18,6 +25,51 @@ func TestNodeStageVolume_NoArguments(t *testing.T) {
 	assert.Nil(t, resp)
 }
 
+func TestNodeStageVolume_KerberosWithoutKeytabOrPassword(t *testing.T) {
+	req := csi.NodeStageVolumeRequest{
+		VolumeId: "testID",
+		StagingTargetPath: "/tmp/staging",
+		VolumeContext: map[string]string{"server": "server", "share": "share"},
+		Secrets: map[string]string{"principal": "user@EXAMPLE.COM"},
+	}
+	resp, err := d.NodeStageVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestNodeStageVolume_InvalidVolumeMountGroup(t *testing.T) {
+	req := csi.NodeStageVolumeRequest{
+		VolumeId: "testID",
+		StagingTargetPath: "/tmp/staging",
+		VolumeContext: map[string]string{"server": "server", "share": "share"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: "staff"},
+			},
+		},
+	}
+	resp, err := d.NodeStageVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestNodeStageVolume_GidConflictsWithVolumeMountGroup(t *testing.T) {
+	req := csi.NodeStageVolumeRequest{
+		VolumeId: "testID",
+		StagingTargetPath: "/tmp/staging",
+		VolumeContext: map[string]string{"server": "server", "share": "share", "ownership": "mount", "gid": "1000"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: "2000"},
+			},
+		},
+		Secrets: map[string]string{"username": "user", "password": "password"},
+	}
+	resp, err := d.NodeStageVolume(ctx, &req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Nil(t, resp)
+}
+
 func TestNodeUnstageVolume_NoArguments(t *testing.T) {
 	req := csi.NodeUnstageVolumeRequest{}
 	resp, err := d.NodeUnstageVolume(ctx, &req)
@@ -32,6 +84,99 @@ func TestNodePublishVolume_NoArguments(t *testing.T) {
 	assert.Nil(t, resp)
 }
 
+func TestNodePublishVolume_EphemeralNoServer(t *testing.T) {
+	req := csi.NodePublishVolumeRequest{
+		VolumeId: "csi-ephemeral",
+		TargetPath: "/tmp/target",
+		VolumeContext: map[string]string{"csi.storage.k8s.io/ephemeral": "true", "share": "share"},
+	}
+	resp, err := d.NodePublishVolume(ctx, &req)
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestNodeUnpublishVolume_EphemeralAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	nodeJournal, err := journal.Open(filepath.Join(dir, "node-journal.json"))
+	assert.NoError(t, err)
+
+	publishDriver, _ := mock.NewMockDriver("test")
+	publishDriver.Journal = nodeJournal
+	req := csi.NodePublishVolumeRequest{
+		VolumeId: "csi-ephemeral-restart",
+		TargetPath: "/tmp/target-ephemeral",
+		VolumeContext: map[string]string{"csi.storage.k8s.io/ephemeral": "true", "server": "server", "share": "share"},
+		Secrets: map[string]string{"username": "user", "password": "secret"},
+	}
+	resp, err := publishDriver.NodePublishVolume(ctx, &req)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+	entry, isRecorded := nodeJournal.Get(journal.KindEphemeral, "/tmp/target-ephemeral")
+	assert.True(t, isRecorded)
+	assert.Equal(t, "//server/share", entry.Source)
+
+	// The restarted node plugin only knows the volume from the journal
+	restartedDriver, _ := mock.NewMockDriver("test")
+	restartedDriver.Journal = nodeJournal
+	unpublishResp, err := restartedDriver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-ephemeral-restart", TargetPath: "/tmp/target-ephemeral"})
+	assert.NoError(t, err)
+	assert.NotNil(t, unpublishResp)
+	_, isRecorded = nodeJournal.Get(journal.KindEphemeral, "/tmp/target-ephemeral")
+	assert.False(t, isRecorded)
+}
+
+func publishWithAccessMode(mode csi.VolumeCapability_AccessMode_Mode, readOnly bool, targetPath string) (*csi.NodePublishVolumeResponse, error) {
+	req := csi.NodePublishVolumeRequest{
+		VolumeId: "testID",
+		StagingTargetPath: "/tmp/staging",
+		TargetPath: targetPath,
+		Readonly: readOnly,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		},
+	}
+	return d.NodePublishVolume(ctx, &req)
+}
+
+func TestNodePublishVolume_MultiWriterIsWritable(t *testing.T) {
+	resp, err := publishWithAccessMode(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, false, "/tmp/target-rwx")
+	assert.Nil(t, err)
+	assert.NotNil(t, resp)
+	assert.False(t, d.Mounter.(*mock.FakeMounter).BindMounts["/tmp/target-rwx"])
+}
+
+func TestNodePublishVolume_MultiWriterReadonly(t *testing.T) {
+	resp, err := publishWithAccessMode(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, true, "/tmp/target-rwx-ro")
+	assert.Nil(t, err)
+	assert.NotNil(t, resp)
+	assert.True(t, d.Mounter.(*mock.FakeMounter).BindMounts["/tmp/target-rwx-ro"])
+}
+
+func TestNodePublishVolume_MultiReaderOnly(t *testing.T) {
+	resp, err := publishWithAccessMode(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, false, "/tmp/target-rox")
+	assert.Nil(t, err)
+	assert.NotNil(t, resp)
+	assert.True(t, d.Mounter.(*mock.FakeMounter).BindMounts["/tmp/target-rox"])
+}
+
+func TestNodePublishVolume_GroupOfVolumeStagedBeforeRestart(t *testing.T) {
+	req := csi.NodePublishVolumeRequest{
+		VolumeId: "stagedBeforeRestart",
+		StagingTargetPath: "/tmp/staging",
+		TargetPath: "/tmp/target-group",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: "2000"}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	resp, err := d.NodePublishVolume(ctx, &req)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+}
+
 func TestNodeUnpublishVolume_NoArguments(t *testing.T) {
 	req := csi.NodeUnpublishVolumeRequest{}
 	resp, err := d.NodeUnpublishVolume(ctx, &req)
@@ -26,6 +26,16 @@ const (
 
 const logFileName = "/var/log/kubernetes-cifs-volumedriver.log"
 
+// Directory of the short lived credentials files handed to mount.cifs, only accessible by root
+var credentialsDir = "/run/kubernetes-cifs-volumedriver"
+
+// Options of mount.cifs carrying credentials, which are only taken from the secret,
+// as the opts end up in the mount command line and the log
+var credentialOpts = map[string]bool{
+	"username": true, "user": true, "password": true, "pass": true, "password2": true,
+	"credentials": true, "cred": true,
+}
+
 // returnMsg is the response given back to k8s
 type returnMsg struct {
 	Status       string
@@ -120,12 +130,61 @@ func runCommand(cmd *exec.Cmd) error {
 	return nil
 }
 
-func createMountCmd(cmdLineArgs []string) (cmd *exec.Cmd) {
+// writeCredentialsFile writes the credentials in the format of the mount.cifs credentials option,
+// so they neither show up in the mount command line nor in the log.
+// The file must be removed once the mount command finished.
+func writeCredentialsFile(mArgs mounterArgs) (string, error) {
+	if err := os.MkdirAll(credentialsDir, 0700); err != nil {
+		return "", errors.Wrap(err, "Error creating credentials directory")
+	}
+	if err := os.Chmod(credentialsDir, 0700); err != nil {
+		return "", errors.Wrap(err, "Error securing credentials directory")
+	}
+
+	file, err := ioutil.TempFile(credentialsDir, "credentials-")
+	if err != nil {
+		return "", errors.Wrap(err, "Error creating credentials file")
+	}
+	defer file.Close()
+
+	var content bytes.Buffer
+	if mArgs.CredentialUser != "" {
+		content.WriteString(fmt.Sprintf("username=%s\n", strings.Trim(mArgs.CredentialUser, "\n\r")))
+	}
+	if mArgs.CredentialPass != "" {
+		content.WriteString(fmt.Sprintf("password=%s\n", strings.Trim(mArgs.CredentialPass, "\n\r")))
+	}
+	if mArgs.CredentialDomain != "" {
+		content.WriteString(fmt.Sprintf("domain=%s\n", strings.Trim(mArgs.CredentialDomain, "\n\r")))
+	}
+	if _, err := file.Write(content.Bytes()); err != nil {
+		os.Remove(file.Name())
+		return "", errors.Wrap(err, "Error writing credentials file")
+	}
+	return file.Name(), nil
+}
+
+// checkOpts rejects opts carrying credentials
+func checkOpts(opts string) error {
+	for _, opt := range strings.Split(opts, ",") {
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(opt, "=", 2)[0]))
+		if credentialOpts[name] {
+			return errors.Errorf("Option %s is not allowed in opts, the credentials are taken from the secret", name)
+		}
+	}
+	return nil
+}
+
+// createMountCmd builds the mount command and returns the credentials file it refers to, if any
+func createMountCmd(cmdLineArgs []string) (cmd *exec.Cmd, credentialsFile string) {
 	if len(cmdLineArgs) < 4 {
 		panic(retMsgInsufficientArgs)
 	}
 
 	var mArgs mounterArgs = unmarshalMounterArgs(cmdLineArgs[3])
+	if err := checkOpts(mArgs.Opts); err != nil {
+		panic(err.Error())
+	}
 	var optsFinal []string
 	cmd = exec.Command("mount")
 	cmd.Args = append(cmd.Args, "-t")
@@ -137,14 +196,13 @@ func createMountCmd(cmdLineArgs []string) (cmd *exec.Cmd) {
 	if mArgs.ReadWrite != "" {
 		optsFinal = append(optsFinal, mArgs.ReadWrite)
 	}
-	if mArgs.CredentialDomain != "" {
-		optsFinal = append(optsFinal, fmt.Sprintf("domain=%s", strings.Trim(mArgs.CredentialDomain, "\n\r")))
-	}
-	if mArgs.CredentialUser != "" {
-		optsFinal = append(optsFinal, fmt.Sprintf("username=%s", strings.Trim(mArgs.CredentialUser, "\n\r")))
-	}
-	if mArgs.CredentialPass != "" {
-		optsFinal = append(optsFinal, fmt.Sprintf("password=%s", strings.Trim(mArgs.CredentialPass, "\n\r")))
+	if mArgs.CredentialDomain != "" || mArgs.CredentialUser != "" || mArgs.CredentialPass != "" {
+		var err error
+		credentialsFile, err = writeCredentialsFile(mArgs)
+		if err != nil {
+			panic(err.Error())
+		}
+		optsFinal = append(optsFinal, fmt.Sprintf("credentials=%s", credentialsFile))
 	}
 	if mArgs.Opts != "" {
 		optsFinal = append(optsFinal, strings.Split(mArgs.Opts, ",")...)
@@ -175,6 +233,7 @@ func driverMain(args []string) (ret returnMsg) {
 	defer func() {
 		err := recover()
 		if err != nil {
+			ret.Status = retStatFailure
 			ret.Message = fmt.Sprintf("Unexpected executing volume driver: %s", err)
 			return
 		}
@@ -196,7 +255,11 @@ func driverMain(args []string) (ret returnMsg) {
 		ret.Capabilities.FSGroup = false         // avoids chown/chmod upstream in driver caller
 		ret.Capabilities.SupportsMetrics = false // there are no metrics
 	case "mount":
-		cmd := createMountCmd(args)
+		cmd, credentialsFile := createMountCmd(args)
+		if credentialsFile != "" {
+			defer os.Remove(credentialsFile)
+		}
+		// The credentials are in the credentials file, so the arguments are safe to log
 		log.Println(cmd.Args)
 		err = runCommand(cmd)
 		if err != nil {
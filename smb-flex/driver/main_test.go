@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mountArgs(t *testing.T, opts string) []string {
+	encode := base64.StdEncoding.EncodeToString
+	jsonArgs, err := json.Marshal(map[string]string{
+		"server":                        "server",
+		"share":                         "/share",
+		"opts":                          opts,
+		"kubernetes.io/secret/username": encode([]byte("user")),
+		"kubernetes.io/secret/password": encode([]byte("s3cr3t")),
+		"kubernetes.io/secret/domain":   encode([]byte("DOMAIN")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []string{"driver", "mount", "/mnt/target", string(jsonArgs)}
+}
+
+// useTempCredentialsDir points the credentials files to a temporary directory
+func useTempCredentialsDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := credentialsDir
+	credentialsDir = filepath.Join(dir, "credentials")
+	return func() {
+		credentialsDir = previous
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCheckOpts(t *testing.T) {
+	for _, opts := range []string{
+		"user=admin", "pass=secret", "cred=/etc/creds", "username=admin", "password=secret", "password2=secret",
+		"credentials=/etc/creds", "vers=3.0,USER=admin", "Pass=secret", " Cred=/etc/creds",
+	} {
+		if err := checkOpts(opts); err == nil {
+			t.Errorf("opts %q were accepted", opts)
+		}
+	}
+	for _, opts := range []string{"", "vers=3.0", "vers=3.0,dir_mode=0755,uid=1000", "sec=ntlmssp"} {
+		if err := checkOpts(opts); err != nil {
+			t.Errorf("opts %q were rejected: %s", opts, err)
+		}
+	}
+}
+
+func TestCreateMountCmd_RejectsCredentialOpts(t *testing.T) {
+	defer useTempCredentialsDir(t)()
+	ret := driverMain(mountArgs(t, "vers=3.0,User=admin"))
+	if ret.Status != retStatFailure {
+		t.Errorf("mount with a user in the opts returned %s", ret.Status)
+	}
+	if strings.Contains(ret.Message, "s3cr3t") {
+		t.Errorf("message contains the password: %s", ret.Message)
+	}
+}
+
+func TestCreateMountCmd_PasswordIsOnlyInCredentialsFile(t *testing.T) {
+	defer useTempCredentialsDir(t)()
+	cmd, credentialsFile := createMountCmd(mountArgs(t, "vers=3.0"))
+	defer os.Remove(credentialsFile)
+
+	for _, arg := range cmd.Args {
+		if strings.Contains(arg, "s3cr3t") {
+			t.Errorf("mount command contains the password: %v", cmd.Args)
+		}
+	}
+	if !strings.Contains(strings.Join(cmd.Args, " "), "credentials="+credentialsFile) {
+		t.Errorf("mount command does not refer to the credentials file: %v", cmd.Args)
+	}
+
+	info, err := os.Stat(credentialsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("credentials file has mode %o", info.Mode().Perm())
+	}
+	content, _ := ioutil.ReadFile(credentialsFile)
+	if string(content) != "username=user\npassword=s3cr3t\ndomain=DOMAIN\n" {
+		t.Errorf("unexpected credentials file: %q", content)
+	}
+}
+
+func TestDriverMain_RemovesCredentialsFileAfterMount(t *testing.T) {
+	defer useTempCredentialsDir(t)()
+
+	// A fake mount command records the credentials file it got
+	binDir, err := ioutil.TempDir("", "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+	recorded := filepath.Join(binDir, "mounted")
+	script := "#!/bin/sh\necho \"$@\" > " + recorded + "\n"
+	if err := ioutil.WriteFile(filepath.Join(binDir, "mount"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	previousPath := os.Getenv("PATH")
+	os.Setenv("PATH", binDir)
+	defer os.Setenv("PATH", previousPath)
+
+	ret := driverMain(mountArgs(t, "vers=3.0"))
+	if ret.Status != retStatSuccess {
+		t.Fatalf("mount failed: %s", ret.Message)
+	}
+	args, _ := ioutil.ReadFile(recorded)
+	if !strings.Contains(string(args), "credentials="+credentialsDir) || strings.Contains(string(args), "s3cr3t") {
+		t.Errorf("unexpected mount arguments: %s", args)
+	}
+	entries, _ := ioutil.ReadDir(credentialsDir)
+	if len(entries) > 0 {
+		t.Errorf("credentials file %s was left behind", entries[0].Name())
+	}
+	info, err := os.Stat(credentialsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("credentials directory has mode %o", info.Mode().Perm())
+	}
+}